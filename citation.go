@@ -0,0 +1,318 @@
+// citation.go
+//
+// Structured information derived from citation lines.
+package qris
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RIS reference types recognized in `^TY:` override lines.
+var risTypes = map[string]bool{
+	"ABST": true, "ADVS": true, "AGGR": true, "ANCIENT": true, "ART": true,
+	"BILL": true, "BLOG": true, "BOOK": true, "CASE": true, "CHAP": true,
+	"CHART": true, "CLSWK": true, "COMP": true, "CONF": true, "CPAPER": true,
+	"CTLG": true, "DATA": true, "DBASE": true, "DICT": true, "EBOOK": true,
+	"ECHAP": true, "EDBOOK": true, "EJOUR": true, "ELEC": true, "ENCYC": true,
+	"EQUA": true, "FIGURE": true, "GEN": true, "GOVDOC": true, "GRANT": true,
+	"HEAR": true, "ICOMM": true, "INPR": true, "JFULL": true, "JOUR": true,
+	"LEGAL": true, "MANSCPT": true, "MAP": true, "MGZN": true, "MPCT": true,
+	"MULTI": true, "MUSIC": true, "NEWS": true, "PAMP": true, "PAT": true,
+	"PCOMM": true, "RPRT": true, "SER": true, "SLIDE": true, "SOUND": true,
+	"STAND": true, "STAT": true, "THES": true, "UNPB": true, "VIDEO": true,
+}
+
+// The reference type written when none was inferred or specified.
+const DefaultType = "GEN"
+
+// Reference Type Cues
+var thesisCue = regexp.MustCompile(
+	`(?i)\b(?:dissertation|thesis|diss\.|Ph\.?\s?D\.?|doctoral)`)
+var chapterCue = regexp.MustCompile(`[.,”"]\p{Zs}*In:?\p{Zs}+[{“"\p{Lu}]`)
+var journalCue = regexp.MustCompile(
+	`\pN+\p{Zs}*no\.\p{Zs}*\pN+|\pN+\p{Zs}*\([^()]*\pN{4}[^()]*\)\p{Zs}*:|\b[vV]ol\.\p{Zs}*\pN+`)
+var webCue = regexp.MustCompile(`https?://|\bwww\.`)
+var publisherCue = regexp.MustCompile(
+	`\pL[\pL\p{Zs}.,;]*:\p{Zs}*[^:]+?,\p{Zs}*(?:c\.\p{Zs}*)?\pN{4}|\b(?:Press|Verlag|Publishers?|UP)\b`)
+
+// `classifyCitation` infers a RIS reference type from cues in the citation
+// body `b` and the author segment `name`. The empty string is returned if
+// no cue was found.
+func classifyCitation(b, name string) string {
+	switch {
+	case thesisCue.MatchString(b):
+		return "THES"
+	case chapterCue.MatchString(b):
+		return "CHAP"
+	case journalCue.MatchString(b):
+		return "JOUR"
+	case editorMark.MatchString(name):
+		return "EDBOOK"
+	case webCue.MatchString(b):
+		return "ELEC"
+	case publisherCue.MatchString(b):
+		return "BOOK"
+	default:
+		return ""
+	}
+}
+
+// `getType` returns the reference type named by the value `b` of a `^TY:`
+// override line, or the empty string if the type is not a known RIS type.
+func getType(b string) string {
+	ty := strings.ToUpper(strings.TrimSpace(b))
+	if !risTypes[ty] {
+		return ""
+	}
+	return ty
+}
+
+// `LookupType` returns the RIS reference type named `name`, in any case.
+func LookupType(name string) (string, bool) {
+	ty := getType(name)
+	return ty, ty != ""
+}
+
+// Citation Structure
+var quotedTitle = regexp.MustCompile(`[“"]([^”"]+)[”"]`)
+var bracedTitle = regexp.MustCompile(`\{([^{}]*)\}`)
+var unclosedTitle = regexp.MustCompile(`\{([^{}.]*)`)
+var inContainer = regexp.MustCompile(`\bIn:?\p{Zs}+(?:\{([^{}]*)\}?|([^.,{}]+))`)
+var journalIssue = regexp.MustCompile(
+	`(\pN+)\p{Zs}*(?:no\.\p{Zs}*(\pN+)\p{Zs}*)?\([^()]*\)\p{Zs}*:\p{Zs}*(?:(\pN+)(?:\p{Zs}*[-–—]+\p{Zs}*(\pN+))?)?`)
+var chapterPages = regexp.MustCompile(`\((\pN+)\p{Zs}*[-–—]+\p{Zs}*(\pN+)\)\.?$`)
+var placePublisher = regexp.MustCompile(
+	`([^.:{}“”"]+):\p{Zs}*([^:]+?),\p{Zs}*(?:c\.\p{Zs}*)?\pN{4}`)
+var publisherOnly = regexp.MustCompile(
+	`([^.:{}“”",]*\b(?:Press|Verlag|Publishers?|UP)\b[^.:,]*),\p{Zs}*(?:c\.\p{Zs}*)?\pN{4}`)
+
+// `trimTitle` removes surrounding space and trailing punctuation that
+// separates a title from the rest of a citation.
+func trimTitle(s string) string {
+	return strings.TrimRight(strings.TrimSpace(s), " .,;:")
+}
+
+// `expandPage` expands an abbreviated final page using the initial page,
+// e.g., 131-41 becomes 131-141.
+func expandPage(start, end string) string {
+	if len(end) < len(start) && isDigits(start) && isDigits(end) {
+		return start[:len(start)-len(end)] + end
+	}
+	return end
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// `parseCitation` fills the structured fields of `c` from its body. Only the
+// parts that are recognized are filled; the body itself is not changed.
+func parseCitation(c *Citation) {
+	b := stripIdentifiers(c.Body)
+	rest := b // the part of the citation following the titles
+
+	if m := quotedTitle.FindStringSubmatchIndex(b); m != nil {
+		c.Title = trimTitle(b[m[2]:m[3]])
+		rest = b[m[1]:]
+		if im := inContainer.FindStringSubmatchIndex(rest); im != nil {
+			if im[2] >= 0 {
+				c.Container = trimTitle(rest[im[2]:im[3]])
+			} else {
+				c.Container = trimTitle(rest[im[4]:im[5]])
+			}
+			rest = rest[im[1]:]
+		} else if bm := bracedTitle.FindStringSubmatchIndex(rest); bm != nil {
+			c.Container = trimTitle(rest[bm[2]:bm[3]])
+			rest = rest[bm[1]:]
+		} else if um := unclosedTitle.FindStringSubmatchIndex(rest); um != nil {
+			c.Container = trimTitle(rest[um[2]:um[3]])
+			rest = rest[um[1]:]
+		} else if jm := journalIssue.FindStringIndex(rest); jm != nil {
+			// An unmarked journal title runs up to the volume number.
+			c.Container = trimTitle(rest[:jm[0]])
+			rest = rest[jm[0]:]
+		}
+	} else if bm := bracedTitle.FindStringSubmatchIndex(b); bm != nil {
+		c.Title = trimTitle(b[bm[2]:bm[3]])
+		rest = b[bm[1]:]
+	} else if um := unclosedTitle.FindStringSubmatchIndex(b); um != nil {
+		c.Title = trimTitle(b[um[2]:um[3]])
+		rest = b[um[1]:]
+	}
+
+	if m := journalIssue.FindStringSubmatch(rest); m != nil {
+		c.Volume, c.Issue = m[1], m[2]
+		c.StartPage, c.EndPage = m[3], expandPage(m[3], m[4])
+	} else if m := chapterPages.FindStringSubmatch(rest); m != nil {
+		c.StartPage, c.EndPage = m[1], expandPage(m[1], m[2])
+	}
+
+	if m := placePublisher.FindStringSubmatch(rest); m != nil {
+		c.Place = strings.TrimSpace(m[1])
+		c.Publisher = strings.TrimSpace(m[2])
+	} else if m := publisherOnly.FindStringSubmatch(rest); m != nil {
+		c.Publisher = strings.TrimSpace(m[1])
+	}
+}
+
+// Citation Names
+var editorMark = regexp.MustCompile(`[\p{Zs},]*\(?\b(?:eds?|Eds?\.|[Hh]rsg)\.?\)?\.?$`)
+var translatorMark = regexp.MustCompile(`[\p{Zs},]*\(?\b(?:trans|trs?|Trans\.|Tr\.)\.?\)?\.?$`)
+var etAl = regexp.MustCompile(`(?i),?\p{Zs}*\bet\p{Zs}+al\.?`)
+var nameSeparator = regexp.MustCompile(`\p{Zs}+(?:and|&)\p{Zs}+|;\p{Zs}*`)
+var nameSuffix = regexp.MustCompile(`^(?:(?:\p{Lu}\.)+|Jr\.?|Sr\.?|I{2,3}|IV)$`)
+var corporateName = regexp.MustCompile(
+	`\b(?:Association|Society|Institute|Organi[sz]ation|Committee|Council|Commission|` +
+		`Department|Ministry|Office|Agency|Foundation|Group|Center|Centre|Bureau|Board|` +
+		`Academy|University|College|Company|Corporation|Inc\.?|Ltd\.?)\b`)
+var initialToken = regexp.MustCompile(`^(?:\p{Lu}\.)+,?$|^\p{Lu}\.\p{Ll}\.$`)
+var editedBy = regexp.MustCompile(`(?:^|[\p{Zs}.,}])(?:[Ee]ds?\.|[Ee]dited\p{Zs}+by|[Hh]rsg\.(?:\p{Zs}+v\.)?)\p{Zs}+`)
+var translatedBy = regexp.MustCompile(
+	`(?:^|[\p{Zs}.,}])(?:[Tt]rans\.|[Tt]ranslated\p{Zs}+by|[Tt]r\.|[Üü]bers\.(?:\p{Zs}+v\.)?)\p{Zs}+`)
+var translatorsBefore = regexp.MustCompile(
+	`([\p{L}.\p{Zs}'’-]+?(?:\p{Zs}+(?:and|&)\p{Zs}+[\p{L}.\p{Zs}'’-]+?)*)\p{Zs}*\((?:trs?|trans)\.?\)`)
+
+// `isCorporate` returns true if `name` looks like the name of an organization
+// rather than a person.
+func isCorporate(name string) bool {
+	return !strings.Contains(name, ",") && corporateName.MatchString(name)
+}
+
+// `splitNames` splits a list of personal names. If `inverted` is true the
+// first name may be given as "Family, Given", as in the author segment of a
+// citation; otherwise names are taken as written. Initials and suffixes set
+// off by commas stay with the preceding name.
+func splitNames(s string, inverted bool) []string {
+	s = strings.TrimSpace(etAl.ReplaceAllLiteralString(s, ""))
+	if s == "" {
+		return nil
+	}
+	if isCorporate(s) {
+		return []string{s}
+	}
+	var names []string
+	for i, part := range nameSeparator.Split(s, -1) {
+		part = strings.Trim(part, " ,")
+		if part == "" {
+			continue
+		}
+		segs := strings.Split(part, ",")
+		for j := range segs {
+			segs[j] = strings.TrimSpace(strings.TrimLeft(segs[j], " ."))
+		}
+		// Only a family name without initials can begin an inverted name.
+		invert := inverted && len(segs) > 1 && !strings.Contains(segs[0], ".")
+		start := len(names)
+		for j, seg := range segs {
+			switch {
+			case seg == "":
+				continue
+			case len(names) > start && nameSuffix.MatchString(seg):
+				names[len(names)-1] += ", " + seg
+			case invert && j == 1 && len(names) > start: // given names
+				names[start] += ", " + seg
+			case invert && i > 0 && j > 0: // an inverted name after the first
+				names[len(names)-1] += ", " + seg
+			default:
+				names = append(names, seg)
+			}
+		}
+	}
+	return names
+}
+
+// `namesAfter` returns the names which follow the first match of `marker` in
+// `b`. The names end at the first period which does not follow an initial.
+func namesAfter(marker *regexp.Regexp, b string) []string {
+	m := marker.FindStringIndex(b)
+	if m == nil {
+		return nil
+	}
+	var tokens []string
+	for _, tok := range strings.Fields(b[m[1]:]) {
+		if strings.HasSuffix(tok, ".") && !initialToken.MatchString(tok) {
+			tokens = append(tokens, strings.TrimSuffix(tok, "."))
+			break
+		}
+		if strings.ContainsAny(tok, ":{}()“”\"") {
+			break
+		}
+		tokens = append(tokens, tok)
+	}
+	return splitNames(strings.Join(tokens, " "), false)
+}
+
+// `parseNames` fills the author, editor, and translator lists of `c` from
+// the author segment `name` and the citation body.
+func parseNames(c *Citation, name string) {
+	switch {
+	case editorMark.MatchString(name):
+		c.Editors = splitNames(editorMark.ReplaceAllLiteralString(name, ""), true)
+	case translatorMark.MatchString(name):
+		c.Translators = splitNames(translatorMark.ReplaceAllLiteralString(name, ""), true)
+	default:
+		c.Authors = splitNames(name, true)
+	}
+	rest := c.Body[len(name):] // names in the body follow the author segment
+	if c.Editors == nil {
+		c.Editors = namesAfter(editedBy, rest)
+	}
+	if c.Translators == nil {
+		if m := translatorsBefore.FindStringSubmatch(rest); m != nil {
+			tr := strings.TrimSpace(m[1])
+			tr = strings.TrimPrefix(tr, "with ")
+			c.Translators = splitNames(tr, false)
+		} else {
+			c.Translators = namesAfter(translatedBy, rest)
+		}
+	}
+}
+
+// `risName` formats `name` for a RIS author field. EndNote treats a name
+// ending in a comma as a corporate name and does not invert it.
+func risName(name string) string {
+	if isCorporate(name) {
+		return name + ","
+	}
+	return name
+}
+
+// `familyName` returns the family name from a personal name in either
+// "Family, Given" or "Given Family" order.
+func familyName(name string) string {
+	if i := strings.Index(name, ","); i >= 0 {
+		return strings.TrimSpace(name[:i])
+	}
+	if isCorporate(name) {
+		return name
+	}
+	fields := strings.Fields(name)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
+
+// `familyNames` returns a short form of a list of names for use in an
+// "in ..." reference, e.g., "Smith", "Smith and Jones", or "Smith et al.".
+func familyNames(names []string) string {
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return familyName(names[0])
+	case 2:
+		return familyName(names[0]) + " and " + familyName(names[1])
+	default:
+		return familyName(names[0]) + " et al."
+	}
+}
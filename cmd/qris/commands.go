@@ -0,0 +1,168 @@
+// commands.go
+//
+// Subcommands of the qris CLI. A subcommand is selected by the first
+// command line argument, e.g., `qris from-ris library.ris`; without a
+// subcommand qris parses quote files.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"qris"
+)
+
+type subcommand struct {
+	name  string
+	usage string
+	run   func(cmd string, args []string)
+}
+
+var subcommands = []subcommand{
+	{"from-ris", "Convert RIS files into qris quote files.", fromRis},
+	{"check-ris", "Check RIS files for problems before importing them.", checkRis},
+	{"migrate", "Rewrite supplement lines of quote files with a leading %% marker.", migrate},
+}
+
+// `lookupSubcommand` returns the subcommand named `name`, if any.
+func lookupSubcommand(name string) (subcommand, bool) {
+	for _, sc := range subcommands {
+		if sc.name == name {
+			return sc, true
+		}
+	}
+	return subcommand{}, false
+}
+
+// `printSubcommands` lists the available subcommands on the flag output.
+func printSubcommands() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Subcommands:")
+	for _, sc := range subcommands {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", sc.name, sc.usage)
+	}
+}
+
+// `newFlagSet` creates a flag set for a subcommand with a usage message
+// that shows the expected arguments.
+func newFlagSet(cmd, name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s %s:\n  %s %s [flags] %s\n",
+			cmd, name, cmd, name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// `fromRis` converts RIS files, typically exported from EndNote, back into
+// quote files. Each `file.ris` is written as `file_QRIS.txt` or
+// `file_QRIS.docx` alongside the original.
+func fromRis(cmd string, args []string) {
+	fs := newFlagSet(cmd, "from-ris", "file.ris ...")
+	docx := fs.Bool("docx", false, "Write .docx quote files instead of .txt.")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	ext := ".txt"
+	if *docx {
+		ext = ".docx"
+	}
+	for _, f := range fs.Args() {
+		out := strings.TrimSuffix(f, filepath.Ext(f)) + "_QRIS" + ext
+		fmt.Printf("Converting %s...\n", f)
+		if err := qris.RisToQuoteFile(f, out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Wrote", out)
+	}
+}
+
+// `checkRis` validates RIS files and reports each problem found. The exit
+// status is 1 if any file has problems.
+func checkRis(cmd string, args []string) {
+	fs := newFlagSet(cmd, "check-ris", "file.ris ...")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	failed := false
+	for _, f := range fs.Args() {
+		problems, err := qris.CheckRisFile(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("%s: OK\n", f)
+			continue
+		}
+		failed = true
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", f, p)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// `migrate` rewrites the supplement lines of quote files in the canonical
+// form of the grammar, the prefix form if grammar.conf sets
+// "supplement.canonical = prefix" and the suffix form otherwise. A .txt file
+// is rewritten in place; a corrected copy of a .docx file is written as
+// `file_MIGRATED.docx`. Files without lines to migrate are left alone.
+func migrate(cmd string, args []string) {
+	fs := newFlagSet(cmd, "migrate", "file.txt|file.docx ...")
+	grammarPath := fs.String("grammar", "",
+		"Path to a file of markup markers.\nDefaults to grammar.conf in the configuration directory, if present.")
+	strict := fs.Bool("strict", false, "Require every citation to begin with the citation marker.")
+	noTitle := fs.Bool("notitle", false, "Do not take the first line of a quote file as its title.")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	var grammar qris.Grammar
+	var err error
+	if *grammarPath == "" {
+		grammar, err = qris.LoadGrammar(qris.GetGrammarPath(qris.GetConfigPath()))
+	} else {
+		grammar, err = qris.ReadGrammar(*grammarPath)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	form := "suffix"
+	if grammar.SupplementPrefix {
+		form = "prefix"
+	}
+	inOpts := qris.InOpts{Grammar: grammar, Strict: *strict, NoTitle: *noTitle}
+	for _, f := range fs.Args() {
+		n, err := qris.MigrateSupplements(f, inOpts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		switch {
+		case n == 0:
+			fmt.Printf("%s: no supplement lines to migrate to the %s form\n", f, form)
+		case strings.HasSuffix(f, ".docx"):
+			fmt.Printf("%s: %d supplement lines in the %s form; wrote %s\n", f, n, form, qris.MigratedPath(f))
+		default:
+			fmt.Printf("%s: migrated %d supplement lines to the %s form\n", f, n, form)
+		}
+	}
+}
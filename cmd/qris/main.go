@@ -10,11 +10,14 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"time"
 
 	"qris"
 )
@@ -28,8 +31,25 @@ func command(args_0 string) string {
 	return cmd
 }
 
+// Prints the fixes proposed for the quote file at `fpath`.
+func printFixes(fpath string, fixes []qris.Diagnostic) {
+	fmt.Printf("%s: %d proposed fixes\n", filepath.Base(fpath), len(fixes))
+	for _, d := range fixes {
+		fmt.Printf("  line %d: %s\n    - %s\n    + %s\n", d.Line.LineNo, d.Msg,
+			strings.TrimSpace(d.Line.Body), strings.TrimSpace(d.Fix))
+	}
+}
+
 func main() {
 
+	// Dispatch to a subcommand if one was named.
+	if len(os.Args) > 1 {
+		if sc, ok := lookupSubcommand(os.Args[1]); ok {
+			sc.run(command(os.Args[0]), os.Args[2:])
+			return
+		}
+	}
+
 	// Parse command line flags.
 	batchPath := flag.String("b", "",
 		"Path to a directory containing files to be parsed, absolute or relative.")
@@ -37,20 +57,50 @@ func main() {
 		"p, path: Show path to configuration file.\nr, rm, remove: Remove configuration file.")
 	dir := flag.String("d", "",
 		"Set the current working directory.")
-	enc := flag.String("enc", "ansi",
-		"Output encoding.\nOne of 'ascii', 'ansi', 'utf8', or 'utf16'")
+	enc := flag.String("enc", "",
+		"Output encoding.\nOne of 'ascii', 'ansi', 'utf8', or 'utf16'.\n"+
+			"Defaults to the encoding of each output format (ansi for ris).")
 	filePath := flag.String("f", "",
 		"Path to a file to be parsed, absolute or relative.")
 	lineEnd := flag.String("linend", "platform",
 		"Line ending for output.\nOne of 'lf', 'crlf', or 'platform'.")
 	dateStamp := flag.Bool("datestamp", true, "Include AD datestamp field.")
+	dateSource := flag.String("datesource", "now",
+		"Source of the datestamp.\nOne of 'now', 'modtime', 'marker', or a date as YYYY-MM-DD.\n"+
+			"'marker' uses the 'date:' line of each source when there is one.")
+	dateLayout := flag.String("datelayout", qris.DefaultDateLayout,
+		"Layout of the datestamp, e.g., 'YYYY-MM-DD' or a Go time layout.")
+	format := flag.String("format", qris.DefaultFormat,
+		"Comma-separated list of output formats.\nAny of '"+
+			strings.Join(qris.ExporterNames(), "', '")+"'.")
 	volume := flag.Bool("volume", false, "Include VL volume field.")
+	refType := flag.String("type", qris.DefaultType,
+		"RIS reference type for citations whose type cannot be inferred.")
+	profileName := flag.String("profile", qris.DefaultProfile,
+		"RIS tag mapping profile.\nOne of '"+
+			strings.Join(qris.ProfileNames(), "', '")+"'.")
+	grammarPath := flag.String("grammar", "",
+		"Path to a file of markup markers.\nDefaults to grammar.conf in the configuration directory, if present.")
+	noTitle := flag.Bool("notitle", false,
+		"Do not take the first line of a quote file as its title.")
+	strict := flag.Bool("strict", false,
+		"Require every citation to begin with the citation marker.\n"+
+			"Lines before the first citation are kept as a preamble.")
+	mapping := flag.String("mapping", "",
+		"Path to a file mapping fields to RIS tags, applied over -profile\nand over the profile of a '##! profile' directive.")
+	kwAncestors := flag.Bool("kwancestors", false,
+		"Also write each ancestor of a hierarchical keyword, e.g., 'Psychology' for 'Psychology > Self'.")
+	fix := flag.Bool("fix", false,
+		"Propose fixes for mistyped markers and apply them to .txt files after confirmation.\n"+
+			"The original of each fixed file is kept with a .bak suffix, numbered if a backup exists.")
+	yes := flag.Bool("yes", false, "With -fix, apply fixes without asking.")
 
 	// Custom usage message.
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n",
 			command(os.Args[0]))
 		flag.PrintDefaults()
+		printSubcommands()
 	}
 
 	flag.Parse()
@@ -63,18 +113,57 @@ func main() {
 	}
 
 	// Set encoding.
-	var encoding qris.Encoding
-	switch *enc {
-	case "ascii":
-		encoding = qris.Ascii
-	case "ansi":
-		encoding = qris.Ansi
-	case "utf8":
-		encoding = qris.Utf8
-	case "utf16":
-		encoding = qris.Utf16
-	default:
-		encoding = qris.Ansi
+	encoding := qris.None // use the default of each output format
+	if *enc != "" {
+		var ok bool
+		if encoding, ok = qris.LookupEncoding(*enc); !ok {
+			fmt.Fprintf(os.Stderr, "-enc: unrecognized encoding '%s'\n", *enc)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	// Validate output formats.
+	formats, err := qris.ParseFormats(*format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-format: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate the default reference type.
+	defaultType, ok := qris.LookupType(*refType)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "-type: unrecognized RIS reference type '%s'\n", *refType)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Select the RIS tag mapping.
+	profile, ok := qris.LookupProfile(*profileName)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "-profile: unrecognized profile '%s'\n", *profileName)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *mapping != "" {
+		profile, err = qris.ReadProfile(*mapping, profile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	// Select the datestamp source.
+	var fixedDate time.Time
+	source, ok := qris.LookupDateSource(*dateSource)
+	if !ok || source == qris.DateFixed {
+		if fixedDate, ok = qris.ParseDate(*dateSource); !ok {
+			fmt.Fprintf(os.Stderr, "-datesource: unrecognized argument '%s'\n", *dateSource)
+			flag.Usage()
+			os.Exit(1)
+		}
+		source = qris.DateFixed
 	}
 
 	// Configure the system.
@@ -105,6 +194,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Load the markup grammar.
+	var grammar qris.Grammar
+	if *grammarPath == "" {
+		grammar, err = qris.LoadGrammar(qris.GetGrammarPath(configPath))
+	} else {
+		grammar, err = qris.ReadGrammar(*grammarPath)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	// Set a new working directory if needed.
 	qris.SetWorkDir(*dir, configPath)
 
@@ -122,13 +223,59 @@ func main() {
 	dataList, workPath := qris.GetWorkPath(workDir, *batchPath, *filePath)
 
 	outOpts := qris.OutOpts{
-		Volume:    *volume,
-		DateStamp: *dateStamp,
-		Encoding:  encoding,
+		Volume:      *volume,
+		DateStamp:   *dateStamp,
+		Encoding:    encoding,
+		Formats:     formats,
+		DefaultType: defaultType,
+		Profile:     profile,
+		Mapping:     *mapping,
+		DateSource:  source,
+		DateLayout:  qris.DateLayout(*dateLayout),
+		FixedDate:   fixedDate,
+
+		KeywordAncestors: *kwAncestors,
 	}
 
 	// Parse all files.
-	parsedFiles := qris.ProcessQuoteFiles(workPath, dataList)
+	inOpts := qris.InOpts{Grammar: grammar, Strict: *strict, NoTitle: *noTitle}
+	if *fix {
+		stdin := bufio.NewReader(os.Stdin)
+		results, err := qris.FixQuoteFiles(workPath, dataList, inOpts, func(fpath string, fixes []qris.Diagnostic) bool {
+			printFixes(fpath, fixes)
+			if *yes {
+				return true
+			}
+			fmt.Printf("Apply fixes to %s? [y/N] ", filepath.Base(fpath))
+			answer, _ := stdin.ReadString('\n')
+			answer = strings.ToLower(strings.TrimSpace(answer))
+			return answer == "y" || answer == "yes"
+		})
+		for _, r := range results {
+			switch {
+			case r.Fixed > 0:
+				fmt.Printf("%s: fixed %d lines; the original is saved as %s\n",
+					filepath.Base(r.Filepath), r.Fixed, filepath.Base(r.Backup))
+			case filepath.Ext(r.Filepath) == ".docx":
+				printFixes(r.Filepath, r.Fixes)
+				fmt.Println("  .docx files must be fixed by hand")
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	parsedFiles := qris.ProcessQuoteFiles(workPath, dataList, inOpts)
+
+	// Report values which the RIS profile has no tags for.
+	for i, pf := range parsedFiles {
+		ds := qris.OutputDiagnostics(pf, outOpts)
+		for _, d := range ds {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", filepath.Base(pf.Filepath), d)
+		}
+		parsedFiles[i].Diagnostics = append(pf.Diagnostics, ds...)
+	}
 
 	// Write parsed content to output.
 	qris.WriteResults(parsedFiles, outOpts)
@@ -15,6 +15,12 @@ import (
 const Version = "v0.19.2"
 const parsedSuffix = "_PARSED.ris"
 const discardSuffix = "_DISCARD.txt"
+const jsonSuffix = "_PARSED.json"
+const sourcesSuffix = "_SOURCES.json"
+const diagnosticsSuffix = "_DIAGNOSTICS.json"
+const canonSuffix = "_CANON.docx"
+const canonTxtSuffix = "_CANON.txt"
+const migratedSuffix = "_MIGRATED.docx"
 const configDir = "qris"
 const configFile = "qris.conf"
 
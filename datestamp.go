@@ -0,0 +1,97 @@
+// datestamp.go
+//
+// Datestamps written to RIS records.
+//
+// The datestamp of a record may be the time a file was processed, the
+// modification time of the input file, a fixed date, or the date given on a
+// `date:` line following a citation. The layout of the datestamp is a Go
+// time layout, or a pattern using "YYYY", "MM", and "DD".
+package qris
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// A `DateSource` selects where the datestamp of a record comes from.
+type DateSource int
+
+const (
+	DateNow     DateSource = iota // time of processing
+	DateModTime                   // modification time of the input file
+	DateFixed                     // `OutOpts.FixedDate`
+	DateMarker                    // `date:` line of the source, else time of processing
+)
+
+var dateSourceNames = map[string]DateSource{
+	"now":     DateNow,
+	"modtime": DateModTime,
+	"fixed":   DateFixed,
+	"marker":  DateMarker,
+}
+
+// `LookupDateSource` returns the `DateSource` named `name`.
+func LookupDateSource(name string) (DateSource, bool) {
+	ds, ok := dateSourceNames[name]
+	return ds, ok
+}
+
+// The layout used when `OutOpts.DateLayout` is empty.
+const DefaultDateLayout = "2006/01/02"
+
+// Layouts accepted on `date:` lines and for fixed dates.
+var markerLayouts = []string{"2006-01-02", "2006/01/02", "2006-01", "2006/01", "2006"}
+
+// `ParseDate` parses a date written as YYYY-MM-DD, YYYY-MM, or YYYY; slashes
+// may be used in place of hyphens.
+func ParseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range markerLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// `DateLayout` converts a pattern such as "YYYY-MM-DD" into a Go time
+// layout. Go layouts are returned unchanged.
+func DateLayout(pattern string) string {
+	r := strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "DD", "02")
+	return r.Replace(pattern)
+}
+
+// `now` returns the current time from `outOpts.Clock`, if set.
+func (outOpts OutOpts) now() time.Time {
+	if outOpts.Clock != nil {
+		return outOpts.Clock()
+	}
+	return time.Now()
+}
+
+// `datestamper` returns a function which formats the datestamp for each
+// citation of `pf`.
+func datestamper(pf ParsedFile, outOpts OutOpts) func(c Citation) string {
+	layout := outOpts.DateLayout
+	if layout == "" {
+		layout = DefaultDateLayout
+	}
+	stamp := outOpts.now()
+	switch outOpts.DateSource {
+	case DateModTime:
+		if info, err := os.Stat(pf.Filepath); err == nil {
+			stamp = info.ModTime()
+		}
+	case DateFixed:
+		stamp = outOpts.FixedDate
+	}
+	return func(c Citation) string {
+		if outOpts.DateSource == DateMarker && c.Date != "" {
+			if t, ok := ParseDate(c.Date); ok {
+				return t.Format(layout)
+			}
+		}
+		return stamp.Format(layout)
+	}
+}
@@ -0,0 +1,201 @@
+// diagnostic.go
+//
+// Diagnostics for discarded lines and other problems found in quote files.
+//
+// Each `Diagnostic` names the line and the columns to which it applies, a
+// code which identifies the kind of problem, a severity, and an explanation.
+// Discarded lines are errors, since their text is not written to any record,
+// except lines marked for discard with "__", which are reported for
+// information. Lines which were processed but may not have been understood
+// as intended are warnings.
+//
+// Diagnostics are printed as files are processed and written as JSON by the
+// "diagnostics" exporter. Those of discarded lines are also written to the
+// _DISCARD file with the lines to which they apply.
+package qris
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The `Severity` of a `Diagnostic`.
+type Severity int
+
+const (
+	SevInfo Severity = iota
+	SevWarning
+	SevError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SevInfo:
+		return "info"
+	case SevWarning:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// `MarshalText` writes a `Severity` by name in JSON.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Diagnostic codes. Codes beginning with "D" accompany discarded lines;
+// codes beginning with "W" accompany lines which were kept.
+const (
+	CodeUnknownLine      = "D001" // not recognized as markup
+	CodeMarkedDiscard    = "D002" // marked for discard with "__"
+	CodePageSeparator    = "D003" // page marker not set off by a tab or three spaces
+	CodePageSpace        = "D004" // no space between "p." and the page number
+	CodeNoteBeforeQuote  = "D005" // quote markup before the first quote of a source
+	CodeNoteAfterQuote   = "D006" // citation note after a quote
+	CodeUnknownType      = "D007" // reference type override names no RIS type
+	CodeBadDate          = "D008" // date line without a valid date
+	CodeStrayBlockClose  = "D009" // block close without an open block
+	CodeUnexpectedLine   = "D010" // line in an unexpected parse state
+	CodeNearMiss         = "D011" // marker nearly matches a marker of the grammar
+	CodePageUnknown      = "W001" // page group cannot be parsed
+	CodeNoYear           = "W002" // citation without a year
+	CodeInvalidId        = "W003" // DOI, ISBN, or ISSN fails its check
+	CodeUnclosedBlock    = "W004" // block not closed before the end of the file
+	CodeInvalidDirective = "W005" // unknown or invalid `##!` directive
+	CodeNearCitation     = "W006" // line kept, but its marker nearly matches the citation marker
+	CodeTagOverflow      = "W007" // more values than tags of the RIS profile
+)
+
+// A `Diagnostic` reports a problem with `Line`. `Col` and `EndCol` are the
+// first and last columns, counted in characters from 1, of the text of
+// `Line.Body` to which it applies; they are 0 for problems of the output,
+// which belong to no line. `Fix`, if not empty, is the corrected line; see
+// fix.go.
+type Diagnostic struct {
+	Code     string
+	Severity Severity
+	Line     Line
+	Col      int
+	EndCol   int
+	Msg      string
+	Fix      string
+}
+
+func (d Diagnostic) String() string {
+	if d.Col == 0 {
+		return fmt.Sprintf("%s %s: %s", d.Severity, d.Code, d.Msg)
+	}
+	return fmt.Sprintf("line %d, col %d-%d: %s %s: %s",
+		d.Line.LineNo, d.Col, d.EndCol, d.Severity, d.Code, d.Msg)
+}
+
+// `span` returns the columns of the bytes `start` to `end` of `l.Body`.
+func span(l Line, start, end int) (int, int) {
+	return utf8.RuneCountInString(l.Body[:start]) + 1, utf8.RuneCountInString(l.Body[:end])
+}
+
+// `lineSpan` returns the columns of the text of `l` without surrounding
+// white space.
+func lineSpan(l Line) (int, int) {
+	body := strings.TrimSpace(l.Body)
+	start := strings.Index(l.Body, body)
+	return span(l, start, start+len(body))
+}
+
+// `diagnose` returns a `Diagnostic` for the whole text of `l`.
+func diagnose(l Line, sev Severity, code, msg string) Diagnostic {
+	col, endCol := lineSpan(l)
+	return Diagnostic{Code: code, Severity: sev, Line: l, Col: col, EndCol: endCol, Msg: msg}
+}
+
+// `warn` records a warning about `l`.
+func (pf *ParsedFile) warn(l Line, code, msg string) {
+	pf.Diagnostics = append(pf.Diagnostics, diagnose(l, SevWarning, code, msg))
+}
+
+// `discard` records the discarded line of `d`.
+func (pf *ParsedFile) discard(d Diagnostic) {
+	pf.Discards = append(pf.Discards, d.Line)
+	pf.Diagnostics = append(pf.Diagnostics, d)
+}
+
+// Page markers which would end a quote but for their spacing.
+var pageSeparatorMiss = regexp.MustCompile(
+	`\S(\p{Zs}{1,2}[pP]{1,2}\.?\p{Zs}+[\pNiIvVxXlL?][\pNiIvVxXlL?f,\p{Pd}\p{Zs}]*)$`)
+var pageSpaceMiss = regexp.MustCompile(
+	`(?:\t|\p{Zs}{3})\p{Zs}*(([pP]{1,2}\.?)[\pN][\pN,\p{Pd}\p{Zs}f]*)$`)
+
+// `explainUnknown` returns the `Diagnostic` of the unrecognized line `l`
+// in parse state `ps`.
+func explainUnknown(l Line, ps ParseState, gr *grammar) Diagnostic {
+	body := l.Body
+	if m := pageSeparatorMiss.FindStringSubmatchIndex(body); m != nil {
+		d := diagnose(l, SevError, CodePageSeparator, "")
+		d.Col, d.EndCol = span(l, m[2], m[3])
+		marker := body[m[2]:m[3]]
+		sep := utf8.RuneCountInString(marker) -
+			utf8.RuneCountInString(strings.TrimLeftFunc(marker, unicode.IsSpace))
+		d.Msg = "page marker separated by one space; needs a tab or three spaces"
+		if sep > 1 {
+			d.Msg = "page marker separated by two spaces; needs a tab or three spaces"
+		}
+		d.Fix = body[:m[2]] + "\t" + strings.TrimLeftFunc(marker, unicode.IsSpace)
+		return d
+	}
+	if m := pageSpaceMiss.FindStringSubmatchIndex(body); m != nil {
+		d := diagnose(l, SevError, CodePageSpace,
+			"page marker needs a space between 'p.' and the page number")
+		d.Col, d.EndCol = span(l, m[2], m[3])
+		d.Fix = body[:m[5]] + " " + body[m[5]:]
+		return d
+	}
+	if d, ok := fixNearMiss(l, ps, gr, false); ok {
+		return d
+	}
+	if gr.blockClose.MatchString(strings.TrimSpace(body)) {
+		return diagnose(l, SevError, CodeStrayBlockClose, "block close without an open block")
+	}
+	msg := "line is not recognized as markup"
+	switch ps {
+	case InSource:
+		msg = "line is not a quote; quotes end in a page marker, e.g., a tab and 'p. 12'"
+	case InQuote:
+		msg = "line is not a quote, or a note, supplement, keyword, author, or URL line"
+	}
+	return diagnose(l, SevError, CodeUnknownLine, msg)
+}
+
+// `misplaced` returns a `Diagnostic` if markup of type `lt` may not appear
+// in parse state `ps`.
+func misplaced(l Line, lt LineType, ps ParseState) (Diagnostic, bool) {
+	switch {
+	case ps == InSource && (lt == QuoteNoteLn || lt == SupplementLn ||
+		lt == TranslationLn || lt == OriginalLn || lt == QuoteNoteBlockLn ||
+		lt == SupplementBlockLn || lt == TranslationBlockLn || lt == OriginalBlockLn):
+		return diagnose(l, SevError, CodeNoteBeforeQuote,
+			"note line before any quote; notes, supplements, and translations follow their quote"), true
+	case ps == InQuote && (lt == CitationNoteLn || lt == CitationNoteBlockLn):
+		return diagnose(l, SevError, CodeNoteAfterQuote,
+			"citation note after a quote; citation notes directly follow the citation"), true
+	}
+	return Diagnostic{}, false
+}
+
+// `writeDiagnostics` writes the diagnostics of `pf` as JSON.
+func writeDiagnostics(pf ParsedFile, fname string, outOpts OutOpts) error {
+	ds := pf.Diagnostics
+	if ds == nil {
+		ds = []Diagnostic{}
+	}
+	data, err := json.MarshalIndent(ds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fname, append(data, '\n'), 0666)
+}
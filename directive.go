@@ -0,0 +1,147 @@
+// directive.go
+//
+// In-file directives.
+//
+// A comment line beginning "##!" is a directive which sets an option for the
+// quote file in which it appears, e.g.:
+//
+//	##! strict
+//	##! enc = utf8
+//	##! profile = standard
+//	##! type = CHAP
+//	##! batch = Stoics
+//	##! keyword = Stoics; ethics
+//	##! quote.note = abc
+//
+// "strict" selects strict mode and must precede the first citation. The
+// keys of a grammar file change the markup grammar from the next line on.
+// "keyword" adds keywords to every source of the file, so that the keyword
+// marker of the grammar cannot be set by a directive. The other directives
+// override the `OutOpts` used when the file is written. Unknown directives
+// and invalid values are reported as diagnostics and otherwise ignored.
+package qris
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A `Directive` is an output directive read from `Line`.
+type Directive struct {
+	Line  Line
+	Key   string
+	Value string
+}
+
+// `outputDirectives` apply the value of each output directive to `OutOpts`.
+var outputDirectives = map[string]func(o *OutOpts, v string) error{
+	"enc": func(o *OutOpts, v string) error {
+		enc, ok := LookupEncoding(strings.ToLower(v))
+		if !ok {
+			return fmt.Errorf("unknown encoding '%s'", v)
+		}
+		o.Encoding = enc
+		return nil
+	},
+	"profile": func(o *OutOpts, v string) error {
+		p, ok := LookupProfile(strings.ToLower(v))
+		if !ok {
+			return fmt.Errorf("unknown profile '%s'", v)
+		}
+		if o.Mapping != "" {
+			var err error
+			if p, err = ReadProfile(o.Mapping, p); err != nil {
+				return err
+			}
+		}
+		o.Profile = p
+		return nil
+	},
+	"type": func(o *OutOpts, v string) error {
+		ty := getType(v)
+		if ty == "" {
+			return fmt.Errorf("unknown reference type '%s'", v)
+		}
+		o.DefaultType = ty
+		return nil
+	},
+	"batch": func(o *OutOpts, v string) error {
+		if v == "" {
+			return fmt.Errorf("empty batch ID")
+		}
+		o.Volume, o.Batch = true, v
+		return nil
+	},
+}
+
+// `getDirective` returns the key and value of the comment line `b` if it is
+// a directive.
+func getDirective(b string, gr *grammar) (key, value string, ok bool) {
+	d, ok := strings.CutPrefix(strings.TrimSpace(gr.comment.ReplaceAllLiteralString(b, "")), "!")
+	if !ok {
+		return "", "", false
+	}
+	key, value, _ = strings.Cut(d, "=")
+	return strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value), true
+}
+
+// `directive` applies the directive `key` with `value` read from line `l`,
+// and returns the grammar used for the following lines.
+func (pf *ParsedFile) directive(l Line, key, value string, gr *grammar) *grammar {
+	warn := func(format string, a ...any) {
+		pf.warn(l, CodeInvalidDirective, fmt.Sprintf(format, a...))
+	}
+	switch key {
+	case "strict":
+		if pf.State != Start {
+			warn("strict directive must precede the first citation")
+			break
+		}
+		pf.State = InPreamble
+	case "keyword":
+		kws := splitKeywords(value, gr.KeywordSeparators)
+		if len(kws) == 0 {
+			warn("empty keyword directive")
+		}
+		pf.keywords = append(pf.keywords, kws...)
+	default:
+		if apply, ok := outputDirectives[key]; ok {
+			if err := apply(&OutOpts{}, value); err != nil {
+				warn("directive %s: %v", key, err)
+				break
+			}
+			pf.Directives = append(pf.Directives, Directive{Line: l, Key: key, Value: value})
+			break
+		}
+		g := gr.Grammar
+		found, err := g.set(key, value)
+		if !found {
+			warn("unknown directive '%s'", key)
+			break
+		}
+		if err == nil {
+			err = g.Validate()
+		}
+		if err != nil {
+			warn("directive %s: %v", key, err)
+			break
+		}
+		pf.Grammar = g
+		return g.compile()
+	}
+	return gr
+}
+
+// `fileOutOpts` returns `outOpts` with the output directives of `pf`
+// applied, and a warning for each directive which cannot be applied over
+// `outOpts`, e.g., because its mapping file cannot be read.
+func (pf ParsedFile) fileOutOpts(outOpts OutOpts) (OutOpts, []Diagnostic) {
+	var ds []Diagnostic
+	for _, d := range pf.Directives {
+		if err := outputDirectives[d.Key](&outOpts, d.Value); err != nil {
+			ds = append(ds, diagnose(d.Line, SevWarning, CodeInvalidDirective,
+				fmt.Sprintf("directive %s: %v", d.Key, err)))
+		}
+	}
+	return outOpts, ds
+}
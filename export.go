@@ -0,0 +1,168 @@
+// export.go
+//
+// Output formats for parsed quote files.
+//
+// Each output format is an `Exporter` held in a registry keyed by name.
+// `WriteResults` writes every parsed file once for each format named in
+// `OutOpts.Formats`, so new formats can be added by registering an
+// `Exporter` without changes to the CLI.
+package qris
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The format used when `OutOpts.Formats` is empty.
+const DefaultFormat = "ris"
+
+// An `Exporter` writes a `ParsedFile` to an output file. The output file is
+// named by replacing the extension of the input file with `Suffix()`. When
+// `OutOpts.Encoding` is `None` the exporter's own `Encoding()` is used.
+type Exporter interface {
+	Name() string
+	Suffix() string
+	Encoding() Encoding
+	Write(pf ParsedFile, fname string, outOpts OutOpts) error
+}
+
+// `exporter` is a function-backed `Exporter` used for the built-in formats.
+type exporter struct {
+	name   string
+	suffix string
+	enc    Encoding
+	write  func(pf ParsedFile, fname string, outOpts OutOpts) error
+}
+
+func (e exporter) Name() string       { return e.name }
+func (e exporter) Suffix() string     { return e.suffix }
+func (e exporter) Encoding() Encoding { return e.enc }
+func (e exporter) Write(pf ParsedFile, fname string, outOpts OutOpts) error {
+	return e.write(pf, fname, outOpts)
+}
+
+var exporters = map[string]Exporter{}
+
+// `RegisterExporter` adds `e` to the registry, replacing any exporter
+// already registered under the same name.
+func RegisterExporter(e Exporter) {
+	exporters[e.Name()] = e
+}
+
+// `LookupExporter` returns the exporter registered as `name`.
+func LookupExporter(name string) (Exporter, bool) {
+	e, ok := exporters[name]
+	return e, ok
+}
+
+// `ExporterNames` returns the names of all registered exporters, sorted.
+func ExporterNames() []string {
+	var names []string
+	for name := range exporters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// `ParseFormats` splits the comma-separated list of format names `list`,
+// and returns an error naming the first format which is not registered.
+// Repeated names are written once.
+func ParseFormats(list string) ([]string, error) {
+	var formats []string
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if _, ok := LookupExporter(f); !ok {
+			return nil, fmt.Errorf("unrecognized output format '%s'", f)
+		}
+		if !slices.Contains(formats, f) {
+			formats = append(formats, f)
+		}
+	}
+	return formats, nil
+}
+
+// `isExportFile` returns true if `s` is named like the output of a
+// registered exporter.
+func isExportFile(s string) bool {
+	for _, e := range exporters {
+		if strings.HasSuffix(s, e.Suffix()) {
+			return true
+		}
+	}
+	return false
+}
+
+// `fileTitle` returns the title used for generated quote files: the title
+// line of `pf`, or else the name of its file.
+func fileTitle(pf ParsedFile) string {
+	if pf.Title != "" {
+		return pf.Title
+	}
+	fpath := pf.Filepath
+	return filepath.Base(strings.TrimSuffix(fpath, filepath.Ext(fpath)))
+}
+
+func writeJson(pf ParsedFile, fname string, outOpts OutOpts) error {
+	data, err := json.MarshalIndent(pf.Sources, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fname, append(data, '\n'), 0666)
+}
+
+func init() {
+	RegisterExporter(exporter{
+		name:   "ris",
+		suffix: parsedSuffix,
+		enc:    Ansi,
+		write:  writeRis,
+	})
+	RegisterExporter(exporter{
+		name:   "json",
+		suffix: jsonSuffix,
+		enc:    Utf8,
+		write:  writeJson,
+	})
+	RegisterExporter(exporter{
+		name:   "diagnostics",
+		suffix: diagnosticsSuffix,
+		enc:    Utf8,
+		write:  writeDiagnostics,
+	})
+	RegisterExporter(exporter{
+		name:   "docx",
+		suffix: canonSuffix,
+		enc:    Utf8,
+		write: func(pf ParsedFile, fname string, outOpts OutOpts) error {
+			return writeDocx(sourcesToMarkup(fileTitle(pf), pf.Sources, pf.Grammar), fname)
+		},
+	})
+	RegisterExporter(exporter{
+		name:   "txt",
+		suffix: canonTxtSuffix,
+		enc:    Utf8,
+		write: func(pf ParsedFile, fname string, outOpts OutOpts) error {
+			return writeTxt(sourcesToMarkup(fileTitle(pf), pf.Sources, pf.Grammar), fname, outOpts.Encoding)
+		},
+	})
+}
+
+// `exportFile` writes `pf` in the format named `format`.
+func exportFile(pf ParsedFile, format string, outOpts OutOpts) error {
+	e, ok := LookupExporter(format)
+	if !ok {
+		return fmt.Errorf("unknown output format '%s'", format)
+	}
+	outOpts, _ = pf.fileOutOpts(outOpts) // warnings are reported by `OutputDiagnostics`
+	if outOpts.Encoding == None {
+		outOpts.Encoding = e.Encoding()
+	}
+	fpath := pf.Filepath
+	base := strings.TrimSuffix(fpath, filepath.Ext(fpath))
+	return e.Write(pf, base+e.Suffix(), outOpts)
+}
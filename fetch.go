@@ -16,7 +16,9 @@ import (
 
 var isDocx = regexp.MustCompile(`\.docx$`)
 var isTxt = regexp.MustCompile(`\.txt$`)
+var isJson = regexp.MustCompile(sourcesSuffix + `$`)
 var isDiscard = regexp.MustCompile(discardSuffix + `$`)
+var isMigrated = regexp.MustCompile(migratedSuffix + `$`)
 
 //var isRis = regexp.MustCompile(`\.ris`)
 //var isParsed = regexp.MustCompile(parsedSuffix + `$`)
@@ -51,16 +53,30 @@ func isTxtFile(s string) bool {
 	return isTxt.MatchString(s)
 }
 
+// `isJsonFile` returns true if `s` ends with `sourcesSuffix`. Other .json
+// files, e.g., exported `_PARSED.json` files, are not read as input; rename
+// one to end in `sourcesSuffix` to read it back.
+func isJsonFile(s string) bool {
+	return isJson.MatchString(s)
+}
+
 // `isDiscardFile` returns true if `s` ends with `discardSuffix`.
 func isDiscardFile(s string) bool {
 	return isDiscard.MatchString(s)
 	//	return discardFile.FindStringIndex(f) != nil
 }
 
+// `isMigratedFile` returns true if `s` ends with `migratedSuffix`. The copy
+// of a .docx file written by `MigrateSupplements` is not input, so that its
+// sources are not read twice alongside the original.
+func isMigratedFile(s string) bool {
+	return isMigrated.MatchString(s)
+}
+
 // `notInputFile` returns true if `s` should NOT be processed.
 func notInputFile(s string) bool {
-	return !(isDocxFile(s) ||
-		(isTxtFile(s) && !isDiscardFile(s)))
+	return isExportFile(s) || isDiscardFile(s) || isMigratedFile(s) ||
+		!(isDocxFile(s) || isTxtFile(s) || isJsonFile(s))
 }
 
 // Takes a `fpath` argument which leads to a .txt file and
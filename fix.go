@@ -0,0 +1,327 @@
+// fix.go
+//
+// Near-miss markers and automatic fixes.
+//
+// A line which is discarded because its marker is mistyped, e.g., "jrm" for
+// "jmr" or "<S>" for "<$>", or because Word replaced a character of the
+// marker, e.g., "–nb" for "-nb", is diagnosed with a proposed fix: the line
+// with the intended marker. A fix is proposed only if the fixed line is
+// recognized as the markup which the marker begins or ends, and that markup
+// may appear where the line is. Page markers which are not set off by a tab
+// or three spaces, or which have no space after "p.", are fixed in the same
+// way.
+//
+// `ApplyFixes` writes the fixes to a .txt quote file, keeping a backup of the
+// original which never replaces an earlier backup; fixes to .docx files must
+// be made by hand.
+package qris
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const backupSuffix = ".bak"
+
+// Characters which Word substitutes as it autocorrects.
+var smartChars = strings.NewReplacer(
+	"–", "-", "—", "--", "“", `"`, "”", `"`, "‘", "'", "’", "'", "…", "...", " ", " ")
+
+// The line type of each marker which may be fixed.
+var markerLineTypes = map[string]LineType{
+	"citation":      CitationLn,
+	"citation.note": CitationNoteLn,
+	"multiquote":    MultiQuoteLn,
+	"quote.note":    QuoteNoteLn,
+	"quote.author":  QuoteAuthorLn,
+	"supplement":    SupplementLn,
+	"keyword":       KeywordLn,
+	"type":          TypeLn,
+	"date":          DateLn,
+	"translation":   TranslationLn,
+	"original":      OriginalLn,
+	"language":      LanguageLn,
+}
+
+// `nearMarker` returns true if `s` is the marker `m` but for Word's smart
+// characters, letter case, one transposition, one inserted or deleted
+// punctuation mark or symbol, or one punctuation mark or symbol of `m`
+// replaced by a character which is not a digit. Digits are never taken for
+// mistyped marker characters, so that, e.g., "5%" is not read as "%%".
+func nearMarker(s, m string) bool {
+	s = smartChars.Replace(s)
+	if strings.EqualFold(s, m) {
+		return true
+	}
+	a, b := []rune(strings.ToLower(s)), []rune(strings.ToLower(m))
+	switch len(a) - len(b) {
+	case 0:
+		var diffs []int
+		for i := range a {
+			if a[i] != b[i] {
+				diffs = append(diffs, i)
+			}
+		}
+		switch len(diffs) {
+		case 1:
+			i := diffs[0]
+			return isMarkerRune(b[i]) && !unicode.IsDigit(a[i])
+		case 2:
+			i, j := diffs[0], diffs[1]
+			return j == i+1 && a[i] == b[j] && a[j] == b[i]
+		}
+	case -1: // a character of the marker is missing
+		return dropsMarkerRune(b, a)
+	case 1: // a character is added to the marker
+		return dropsMarkerRune(a, b)
+	}
+	return false
+}
+
+// `isMarkerRune` returns true if `r` is a punctuation mark or symbol, the
+// characters of a marker which may be mistyped.
+func isMarkerRune(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// `dropsMarkerRune` returns true if removing one punctuation mark or symbol
+// from `long` gives `short`.
+func dropsMarkerRune(long, short []rune) bool {
+	for i, r := range long {
+		if isMarkerRune(r) && string(long[:i])+string(long[i+1:]) == string(short) {
+			return true
+		}
+	}
+	return false
+}
+
+// `isWordRune` returns true if `r` may be part of a word.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// A `nearMiss` is a line whose marker nearly matches `Marker`: the runes
+// `start` to `end` of the line are replaced by the marker in `Fixed`.
+type nearMiss struct {
+	Key, Marker string
+	Fixed       string
+	start, end  int
+}
+
+// `nearMisses` returns the near misses of the prefix and suffix markers of
+// `gr` in the trimmed line `body` in parse state `ps`.
+func nearMisses(body string, ps ParseState, gr *grammar) []nearMiss {
+	var nms []nearMiss
+	rs := []rune(body)
+	propose := func(key, m string, start, end int, fixed string) {
+		lt := determineLineType(fixed, ps, gr)
+		if _, bad := misplaced(Line{}, lt, ps); lt == markerLineTypes[key] && !bad {
+			nms = append(nms, nearMiss{Key: key, Marker: m, Fixed: fixed, start: start, end: end})
+		}
+	}
+	g := gr.Grammar
+	for _, mk := range g.markers() {
+		m := *mk.marker
+		if _, ok := markerLineTypes[mk.key]; !ok {
+			continue
+		}
+		n := utf8.RuneCountInString(m)
+		// Prefix markers; the supplement marker is both.
+		if (!mk.suffix || mk.key == "supplement") &&
+			!strings.HasPrefix(body, m) {
+			for _, k := range []int{n, n - 1, n + 1} {
+				// The marker must end at a word boundary.
+				if k <= 0 || k > len(rs) || k < len(rs) && isWordRune(rs[k-1]) && isWordRune(rs[k]) {
+					continue
+				}
+				if nearMarker(string(rs[:k]), m) {
+					propose(mk.key, m, 0, k, m+string(rs[k:]))
+					break
+				}
+			}
+		}
+		// Suffix markers, which may be followed by a period.
+		if mk.suffix {
+			end := len(rs)
+			if end > 0 && rs[end-1] == '.' {
+				end--
+			}
+			start := end - n
+			// The marker must begin at a word boundary.
+			if start >= 0 && !strings.HasSuffix(string(rs[:end]), m) &&
+				!(start > 0 && isWordRune(rs[start-1]) && isWordRune(rs[start])) &&
+				nearMarker(string(rs[start:end]), m) {
+				propose(mk.key, m, start, len(rs), string(rs[:start])+m)
+			}
+		}
+		if len(nms) > 0 {
+			break
+		}
+	}
+	return nms
+}
+
+// `fixNearMiss` returns a `Diagnostic` proposing a fix for the discarded
+// line `l`, which nearly matches a marker of `gr`, or false if it matches
+// none. Only the citation marker is considered if `citationOnly` is true;
+// the line is then kept, and the `Diagnostic` is a warning.
+func fixNearMiss(l Line, ps ParseState, gr *grammar, citationOnly bool) (Diagnostic, bool) {
+	sev, code := SevError, CodeNearMiss
+	if citationOnly {
+		sev, code = SevWarning, CodeNearCitation
+	}
+	body := strings.TrimSpace(l.Body)
+	for _, nm := range nearMisses(body, ps, gr) {
+		if citationOnly && nm.Key != "citation" {
+			continue
+		}
+		rs := []rune(body)
+		d := diagnose(l, sev, code, fmt.Sprintf("'%s' looks like the %s marker '%s'",
+			string(rs[nm.start:nm.end]), nm.Key, nm.Marker))
+		offset := utf8.RuneCountInString(l.Body[:strings.Index(l.Body, body)])
+		d.Col, d.EndCol = offset+nm.start+1, offset+nm.end
+		d.Fix = strings.Replace(l.Body, body, nm.Fixed, 1)
+		return d, true
+	}
+	return Diagnostic{}, false
+}
+
+// `Fixes` returns the diagnostics of `pf` which propose a fix.
+func (pf ParsedFile) Fixes() []Diagnostic {
+	var fixes []Diagnostic
+	for _, d := range pf.Diagnostics {
+		if d.Fix != "" {
+			fixes = append(fixes, d)
+		}
+	}
+	return fixes
+}
+
+// `rewriteTxtLines` replaces the lines of the .txt file at `fpath` numbered
+// by the keys of `lines`, counting from 1, keeping their line endings.
+func rewriteTxtLines(fpath string, lines map[int]string) error {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return err
+	}
+	ls := strings.Split(string(data), "\n")
+	for i, line := range ls {
+		fixed, ok := lines[i+1] // text lines are numbered from 1
+		if !ok {
+			continue
+		}
+		ending := ""
+		if strings.HasSuffix(line, "\r") {
+			ending = "\r"
+		}
+		ls[i] = fixed + ending
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fpath, []byte(strings.Join(ls, "\n")), info.Mode())
+}
+
+// `copyFile` copies the file at `src` to `dst`, which must not exist.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// `backupFile` copies the file at `fpath` to the first of "fpath.bak",
+// "fpath.1.bak", "fpath.2.bak", ... which does not exist, and returns the
+// path of the copy.
+func backupFile(fpath string) (string, error) {
+	for n := 0; ; n++ {
+		bak := fpath + backupSuffix
+		if n > 0 {
+			bak = fmt.Sprintf("%s.%d%s", fpath, n, backupSuffix)
+		}
+		err := copyFile(fpath, bak)
+		if !errors.Is(err, fs.ErrExist) {
+			return bak, err
+		}
+	}
+}
+
+// `ApplyFixes` writes the fixes of `ds` to the .txt quote file at `fpath`
+// after copying it to a new backup file, and returns the number of lines
+// fixed and the path of the backup. Nothing is written if there are no
+// fixes.
+func ApplyFixes(fpath string, ds []Diagnostic) (n int, backup string, err error) {
+	if !isTxtFile(fpath) {
+		return 0, "", fmt.Errorf("%s: fixes can only be applied to .txt files", fpath)
+	}
+	lines := map[int]string{}
+	for _, d := range ds {
+		if d.Fix != "" {
+			lines[d.Line.LineNo] = d.Fix
+		}
+	}
+	if len(lines) == 0 {
+		return 0, "", nil
+	}
+	if backup, err = backupFile(fpath); err != nil {
+		return 0, "", err
+	}
+	return len(lines), backup, rewriteTxtLines(fpath, lines)
+}
+
+// A `FixResult` holds the fixes proposed for the quote file at `Filepath`.
+// `Fixed` is the number of lines fixed, and `Backup` the path of the copy of
+// the original, if the fixes were applied.
+type FixResult struct {
+	Filepath string
+	Fixes    []Diagnostic
+	Fixed    int
+	Backup   string
+}
+
+// `FixQuoteFiles` proposes fixes for the quote files of `dataList` in
+// `workPath`, and returns a `FixResult` for each file with proposed fixes.
+// The fixes of a .txt file are applied if `confirm` returns true for them;
+// .docx files are not changed, and `confirm` is not called for them. The
+// results up to the first file which could not be fixed are returned with
+// its error.
+func FixQuoteFiles(workPath string, dataList []string, inOpts InOpts,
+	confirm func(fpath string, fixes []Diagnostic) bool) ([]FixResult, error) {
+	var results []FixResult
+	for _, f := range dataList {
+		if notInputFile(f) || isJsonFile(f) {
+			continue
+		}
+		fpath := filepath.Join(workPath, f)
+		r := FixResult{Filepath: fpath, Fixes: ProcessFile(fpath, inOpts).Fixes()}
+		if len(r.Fixes) == 0 {
+			continue
+		}
+		if isTxtFile(f) && confirm(fpath, r.Fixes) {
+			var err error
+			if r.Fixed, r.Backup, err = ApplyFixes(fpath, r.Fixes); err != nil {
+				return results, err
+			}
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
@@ -0,0 +1,309 @@
+// generate.go
+//
+// Generate canonical quote files from parsed data.
+//
+// This is the reverse of `DocxToLines` and `TxtToLines`: a slice of `Source`s
+// is rendered in canonical qris markup and written as a .docx or .txt file
+// which `ProcessFile` will parse back into the same `Source`s.
+package qris
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Paragraph styles used in generated .docx files.
+const (
+	styleTitle    = "QrisTitle"
+	styleCitation = "QrisCitation"
+	styleQuote    = "QrisQuote"
+	styleMarkup   = "QrisMarkup"
+)
+
+// A `markupLine` is one line of canonical markup together with the paragraph
+// style used when the line is written to a .docx file.
+type markupLine struct {
+	Style string
+	Body  string
+}
+
+// `pageMarker` returns the canonical tab-delimited page marker for `page`.
+// Page groups containing more than one page use "pp.".
+func pageMarker(page string) string {
+	if page == "" {
+		page = "?"
+	}
+	marker := "p. "
+	if strings.ContainsAny(page, ",- –—") {
+		marker = "pp. "
+	}
+	return "\t" + marker + page
+}
+
+// `quoteMarkup` returns the canonical markup lines for a single quote using
+// the markers of `gr`.
+func quoteMarkup(q Quote, gr *grammar) []markupLine {
+	var ls []markupLine
+	switch len(q.Body) {
+	case 0:
+		ls = append(ls, markupLine{styleQuote, pageMarker(q.Page)})
+	case 1:
+		ls = append(ls, markupLine{styleQuote, q.Body[0] + pageMarker(q.Page)})
+	default:
+		last := len(q.Body) - 1
+		ls = append(ls, markupLine{styleQuote, gr.MultiQuote + q.Body[0]})
+		for _, b := range q.Body[1:last] {
+			ls = append(ls, markupLine{styleQuote, b})
+		}
+		ls = append(ls, markupLine{styleQuote, q.Body[last] + pageMarker(q.Page)})
+	}
+	if q.Auth != "" {
+		ls = append(ls, markupLine{styleMarkup, gr.QuoteAuthor + " " + q.Auth})
+	}
+	for _, kw := range q.Keywords {
+		ls = append(ls, markupLine{styleMarkup, gr.Keyword + " " + kw})
+	}
+	for _, supp := range q.Supp {
+		if strings.Contains(supp, "\n") {
+			ls = append(ls, blockMarkup(gr.Supplement, supp, gr)...)
+		} else if gr.SupplementPrefix {
+			ls = append(ls, markupLine{styleMarkup, gr.Supplement + " " + supp})
+		} else {
+			ls = append(ls, markupLine{styleMarkup, supp + " " + gr.Supplement})
+		}
+	}
+	for _, note := range q.Notes {
+		if strings.Contains(note, "\n") {
+			ls = append(ls, blockMarkup(gr.QuoteNote, note, gr)...)
+			continue
+		}
+		// Notes are stored with their marker; add one only if it is missing.
+		if !gr.quoteNote.MatchString(note) {
+			note += " -" + gr.QuoteNote
+		}
+		ls = append(ls, markupLine{styleMarkup, note})
+	}
+	if q.Url != "" {
+		ls = append(ls, markupLine{styleMarkup, q.Url})
+	}
+	ls = append(ls, prefixedMarkup(gr.Translation, q.Translation, gr)...)
+	ls = append(ls, prefixedMarkup(gr.Original, q.Original, gr)...)
+	ls = append(ls, prefixedMarkup(gr.Language, q.Lang, gr)...)
+	return ls
+}
+
+// `blockMarkup` returns the markup lines of a block with marker `m` holding
+// the newline-separated lines of `text`.
+func blockMarkup(m, text string, gr *grammar) []markupLine {
+	ls := []markupLine{{styleMarkup, m + gr.BlockOpen}}
+	for _, b := range strings.Split(text, "\n") {
+		ls = append(ls, markupLine{styleMarkup, b})
+	}
+	return append(ls, markupLine{styleMarkup, gr.BlockClose})
+}
+
+// `prefixedMarkup` returns the markup line with prefix marker `m` holding
+// `text`, or a block if `text` has several lines; it returns no lines if
+// `text` is empty.
+func prefixedMarkup(m, text string, gr *grammar) []markupLine {
+	switch {
+	case text == "":
+		return nil
+	case strings.Contains(text, "\n"):
+		return blockMarkup(m, text, gr)
+	default:
+		return []markupLine{{styleMarkup, m + " " + text}}
+	}
+}
+
+// `sourcesToMarkup` renders `srcs` as canonical qris markup using the
+// markers of `g`. The first line is the file title, which `ProcessFile`
+// reads back as `ParsedFile.Title`.
+func sourcesToMarkup(title string, srcs []Source, g Grammar) []markupLine {
+	gr := g.compile()
+	ls := []markupLine{{styleTitle, title}}
+	for _, s := range srcs {
+		ls = append(ls, markupLine{"", ""})
+		ls = append(ls, markupLine{styleCitation, gr.Citation + " " + s.Citation.Body})
+		if note := s.Citation.Note; strings.Contains(note, "\n") {
+			ls = append(ls, blockMarkup(gr.CitationNote, note, gr)...)
+		} else if note != "" {
+			ls = append(ls, markupLine{styleMarkup, note + " " + gr.CitationNote})
+		}
+		// Only types which differ from the inferred type need an override.
+		if ty := s.Citation.Type; ty != "" && ty != getSource(s.Citation.Body).Citation.Type {
+			ls = append(ls, markupLine{styleMarkup, gr.Type + " " + ty})
+		}
+		if s.Citation.Date != "" {
+			ls = append(ls, markupLine{styleMarkup, gr.Date + " " + s.Citation.Date})
+		}
+		if s.Auth != "" {
+			ls = append(ls, markupLine{styleMarkup, gr.QuoteAuthor + " " + s.Auth})
+		}
+		for _, kw := range s.Keywords {
+			ls = append(ls, markupLine{styleMarkup, gr.Keyword + " " + kw})
+		}
+		if s.Url != "" {
+			ls = append(ls, markupLine{styleMarkup, s.Url})
+		}
+		ls = append(ls, prefixedMarkup(gr.Language, s.Lang, gr)...)
+		for _, q := range s.Quotes {
+			ls = append(ls, quoteMarkup(q, gr)...)
+		}
+	}
+	return ls
+}
+
+// `WriteQuoteFile` writes `srcs` to `fname` as a canonical quote file headed
+// by `title`, using the `DefaultGrammar`. A .docx file is written if `fname`
+// has a .docx extension; otherwise a UTF-8 .txt file is written.
+func WriteQuoteFile(title string, srcs []Source, fname string) error {
+	ls := sourcesToMarkup(title, srcs, DefaultGrammar())
+	if isDocxFile(fname) {
+		return writeDocx(ls, fname)
+	}
+	return writeTxt(ls, fname, Utf8)
+}
+
+func writeTxt(ls []markupLine, fname string, enc Encoding) error {
+	file, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	for _, l := range ls {
+		if err := writeToFile(file, l.Body+LineEnding, enc); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// `xmlText` escapes `s` for use as character data in a .docx part.
+func xmlText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '&':
+			b.WriteString("&amp;")
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '"':
+			b.WriteString("&quot;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// `docxParagraph` renders one line as a WordprocessingML paragraph. Tab
+// characters are written as `<w:tab/>` elements so that page markers survive
+// a round trip through `DocxToLines`.
+func docxParagraph(l markupLine) string {
+	var b strings.Builder
+	b.WriteString("<w:p>")
+	if l.Style != "" {
+		b.WriteString(`<w:pPr><w:pStyle w:val="` + l.Style + `"/></w:pPr>`)
+	}
+	if l.Body != "" {
+		b.WriteString("<w:r>")
+		for i, seg := range strings.Split(l.Body, "\t") {
+			if i > 0 {
+				b.WriteString("<w:tab/>")
+			}
+			if seg != "" {
+				b.WriteString(`<w:t xml:space="preserve">` + xmlText(seg) + "</w:t>")
+			}
+		}
+		b.WriteString("</w:r>")
+	}
+	b.WriteString("</w:p>")
+	return b.String()
+}
+
+const docxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>` +
+	`<Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/>` +
+	`</Types>`
+
+const docxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>` +
+	`</Relationships>`
+
+const docxDocumentRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+	`</Relationships>`
+
+const docxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">` +
+	`<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/>` +
+	`<w:pPr><w:spacing w:after="120"/></w:pPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="` + styleTitle + `"><w:name w:val="Qris Title"/>` +
+	`<w:basedOn w:val="Normal"/><w:rPr><w:b/><w:sz w:val="32"/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="` + styleCitation + `"><w:name w:val="Qris Citation"/>` +
+	`<w:basedOn w:val="Normal"/><w:pPr><w:keepNext/><w:spacing w:before="240"/></w:pPr><w:rPr><w:b/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="` + styleQuote + `"><w:name w:val="Qris Quote"/>` +
+	`<w:basedOn w:val="Normal"/><w:pPr><w:ind w:left="360"/></w:pPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="` + styleMarkup + `"><w:name w:val="Qris Markup"/>` +
+	`<w:basedOn w:val="Normal"/><w:pPr><w:ind w:left="720"/></w:pPr><w:rPr><w:i/></w:rPr></w:style>` +
+	`</w:styles>`
+
+func writeDocx(ls []markupLine, fname string) error {
+	file, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var doc strings.Builder
+	doc.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	doc.WriteString(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>`)
+	for _, l := range ls {
+		doc.WriteString(docxParagraph(l))
+	}
+	doc.WriteString(`</w:body></w:document>`)
+
+	parts := []struct {
+		name string
+		body string
+	}{
+		{"[Content_Types].xml", docxContentTypes},
+		{"_rels/.rels", docxRels},
+		{"word/_rels/document.xml.rels", docxDocumentRels},
+		{"word/styles.xml", docxStyles},
+		{"word/document.xml", doc.String()},
+	}
+
+	zw := zip.NewWriter(file)
+	for _, p := range parts {
+		w, err := zw.Create(p.name)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(p.body)); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// `JsonToSources` reads a JSON array of `Source`s from the file at `fpath`.
+func JsonToSources(fpath string) ([]Source, error) {
+	var srcs []Source
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return srcs, err
+	}
+	err = json.Unmarshal(data, &srcs)
+	return srcs, err
+}
@@ -0,0 +1,318 @@
+// grammar.go
+//
+// The markers of the quote file markup.
+//
+// A `Grammar` holds the marker for each kind of markup line, so that users
+// may choose their own markers, e.g., their own initials in place of "jmr" to
+// mark quote notes. Prefix markers begin a line and suffix markers end one.
+// Markers match only in the case given, except the keyword marker, which
+// matches in any case, e.g., "^s:" for "^S:". A suffix marker which ends in
+// a letter may be followed by a period, e.g., "jmr.".
+//
+// The supplement marker may also begin a line, e.g., "%% see also ...";
+// `SupplementPrefix` selects the prefix form for generated quote files and
+// as the form to which `MigrateSupplements` rewrites supplement lines.
+//
+// `KeywordSeparators` holds the runes which separate the keywords of a
+// keyword list; it may not contain ">", which separates the levels of a
+// hierarchical keyword.
+//
+// A quote note, supplement, citation note, translation, or original may span
+// lines as a block: the marker followed by `BlockOpen` begins the block,
+// e.g., "jmr{", and a line holding only `BlockClose` ends it.
+//
+// Grammars are read from files of `key = marker` lines; keys which are not
+// given keep their default markers:
+//
+//	# My markers
+//	quote.note = abc
+//	keyword = ^K:
+//	supplement.canonical = prefix
+//	keyword.separators = ;,
+package qris
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const grammarFile = "grammar.conf"
+
+// A `Grammar` holds the markers which identify markup lines.
+type Grammar struct {
+	Comment      string // prefix
+	Discard      string // prefix
+	Citation     string // prefix
+	CitationNote string // suffix
+	MultiQuote   string // prefix
+	QuoteNote    string // suffix
+	QuoteAuthor  string // prefix
+	Supplement   string // suffix or prefix
+	Keyword      string // prefix
+	Type         string // prefix
+	Date         string // prefix
+	Translation  string // prefix
+	Original     string // prefix
+	Language     string // prefix
+	BlockOpen    string // follows a prefixed note marker
+	BlockClose   string // alone on a line
+
+	SupplementPrefix  bool   // write supplements in the prefix form
+	KeywordSeparators string // separate the keywords of a keyword list
+}
+
+// `DefaultGrammar` returns the markers qris has always used.
+func DefaultGrammar() Grammar {
+	return Grammar{
+		Comment:      "##",
+		Discard:      "__",
+		Citation:     "<$>",
+		CitationNote: "-nb",
+		MultiQuote:   "///",
+		QuoteNote:    "jmr",
+		QuoteAuthor:  ">>>",
+		Supplement:   "%%",
+		Keyword:      "^S:",
+		Type:         "^TY:",
+		Date:         "date:",
+		Translation:  "^TR:",
+		Original:     "^OR:",
+		Language:     "^LA:",
+		BlockOpen:    "{",
+		BlockClose:   "}",
+
+		KeywordSeparators: ";",
+	}
+}
+
+// A `grammarMarker` describes one marker of a `Grammar`.
+type grammarMarker struct {
+	key    string
+	marker *string
+	suffix bool
+}
+
+func (g *Grammar) markers() []grammarMarker {
+	return []grammarMarker{
+		{"comment", &g.Comment, false},
+		{"discard", &g.Discard, false},
+		{"citation", &g.Citation, false},
+		{"citation.note", &g.CitationNote, true},
+		{"multiquote", &g.MultiQuote, false},
+		{"quote.note", &g.QuoteNote, true},
+		{"quote.author", &g.QuoteAuthor, false},
+		{"supplement", &g.Supplement, true},
+		{"keyword", &g.Keyword, false},
+		{"type", &g.Type, false},
+		{"date", &g.Date, false},
+		{"translation", &g.Translation, false},
+		{"original", &g.Original, false},
+		{"language", &g.Language, false},
+		{"block.open", &g.BlockOpen, true},
+		{"block.close", &g.BlockClose, false},
+	}
+}
+
+// `orDefault` returns `DefaultGrammar` in place of the zero `Grammar`.
+func (g Grammar) orDefault() Grammar {
+	if g == (Grammar{}) {
+		return DefaultGrammar()
+	}
+	return g
+}
+
+// `Validate` reports markers which are empty, contain spaces, or conflict
+// with another marker in the same position: a line beginning with "##x"
+// also begins with "##", so "##" and "##x" could not be told apart.
+func (g Grammar) Validate() error {
+	ms := g.markers()
+	for _, m := range ms {
+		if *m.marker == "" {
+			return fmt.Errorf("grammar: empty marker for %s", m.key)
+		}
+		if strings.ContainsFunc(*m.marker, unicode.IsSpace) {
+			return fmt.Errorf("grammar: marker '%s' for %s contains a space", *m.marker, m.key)
+		}
+	}
+	if strings.Contains(g.KeywordSeparators, keywordLevel) {
+		return fmt.Errorf("grammar: keyword separators may not contain '%s'", keywordLevel)
+	}
+	// The supplement marker is also a prefix marker.
+	ms = append(ms, grammarMarker{"supplement", &g.Supplement, false})
+	for i, a := range ms {
+		for _, b := range ms[i+1:] {
+			if a.suffix != b.suffix || a.marker == b.marker {
+				continue
+			}
+			x, y := *a.marker, *b.marker
+			conflict := false
+			if a.suffix {
+				conflict = strings.HasSuffix(x, y) || strings.HasSuffix(y, x)
+			} else {
+				x, y = strings.ToLower(x), strings.ToLower(y)
+				conflict = strings.HasPrefix(x, y) || strings.HasPrefix(y, x)
+			}
+			if conflict {
+				return fmt.Errorf("grammar: markers '%s' for %s and '%s' for %s conflict",
+					*a.marker, a.key, *b.marker, b.key)
+			}
+		}
+	}
+	return nil
+}
+
+// `set` sets the marker or setting `key` of `g` to `value`. It returns false
+// if `key` is not a key of a grammar file.
+func (g *Grammar) set(key, value string) (bool, error) {
+	switch key {
+	case "supplement.canonical":
+		if value != "prefix" && value != "suffix" {
+			return true, fmt.Errorf("supplement.canonical must be 'prefix' or 'suffix'")
+		}
+		g.SupplementPrefix = value == "prefix"
+		return true, nil
+	case "keyword.separators":
+		g.KeywordSeparators = value
+		return true, nil
+	}
+	for _, m := range g.markers() {
+		if m.key == key {
+			*m.marker = value
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// `ReadGrammar` reads the grammar file at `fpath`. Markers which are not
+// given in the file are taken from `DefaultGrammar`.
+func ReadGrammar(fpath string) (Grammar, error) {
+	g := DefaultGrammar()
+	file, err := os.Open(fpath)
+	if err != nil {
+		return g, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, marker, ok := strings.Cut(line, "=")
+		if !ok {
+			return g, fmt.Errorf("%s:%d: expected 'key = marker'", fpath, lineNo)
+		}
+		key, marker = strings.TrimSpace(key), strings.TrimSpace(marker)
+		found, err := g.set(key, marker)
+		if err != nil {
+			return g, fmt.Errorf("%s:%d: %w", fpath, lineNo, err)
+		}
+		if !found {
+			return g, fmt.Errorf("%s:%d: unknown marker '%s'", fpath, lineNo, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return g, err
+	}
+	if err := g.Validate(); err != nil {
+		return g, fmt.Errorf("%s: %w", fpath, err)
+	}
+	return g, nil
+}
+
+// `GetGrammarPath` returns the path of the grammar file in the
+// configuration directory of `configPath`.
+func GetGrammarPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), grammarFile)
+}
+
+// `LoadGrammar` reads the grammar file at `fpath` if one exists, and
+// otherwise returns `DefaultGrammar`.
+func LoadGrammar(fpath string) (Grammar, error) {
+	if _, err := os.Stat(fpath); err != nil {
+		return DefaultGrammar(), nil
+	}
+	return ReadGrammar(fpath)
+}
+
+// A `grammar` holds the regular expressions compiled from a `Grammar`.
+type grammar struct {
+	Grammar
+	comment, discard, citation, citationNote, multiQuote, quoteNote,
+	quoteAuthor, supplement, supplementPrefix, keyword, typ, date,
+	translation, original, language,
+	citationNoteBlock, quoteNoteBlock, supplementBlock,
+	translationBlock, originalBlock, blockClose *regexp.Regexp
+}
+
+func prefixMarker(m string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(m))
+}
+
+// `foldedPrefixMarker` matches marker `m` in any letter case. Only the
+// keyword marker is matched this way, as "^S:" and "^s:" always have been.
+func foldedPrefixMarker(m string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)^` + regexp.QuoteMeta(m))
+}
+
+// `blockMarker` matches a line which opens a block with marker `m`.
+func blockMarker(m, open string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(m+open))
+}
+
+func suffixMarker(m string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(m)
+	if r := []rune(m); len(r) > 0 && unicode.IsLetter(r[len(r)-1]) {
+		pattern += `\.?`
+	}
+	return regexp.MustCompile(pattern + `$`)
+}
+
+// `compile` compiles the markers of `g`; the zero `Grammar` compiles as
+// `DefaultGrammar`.
+func (g Grammar) compile() *grammar {
+	g = g.orDefault()
+	// Markers added after a grammar was built take their defaults.
+	d := DefaultGrammar()
+	dms := d.markers()
+	for i, m := range g.markers() {
+		if *m.marker == "" {
+			*m.marker = *dms[i].marker
+		}
+	}
+	return &grammar{
+		Grammar:          g,
+		comment:          prefixMarker(g.Comment),
+		discard:          prefixMarker(g.Discard),
+		citation:         prefixMarker(g.Citation),
+		citationNote:     suffixMarker(g.CitationNote),
+		multiQuote:       prefixMarker(g.MultiQuote),
+		quoteNote:        suffixMarker(g.QuoteNote),
+		quoteAuthor:      prefixMarker(g.QuoteAuthor),
+		supplement:       suffixMarker(g.Supplement),
+		supplementPrefix: prefixMarker(g.Supplement),
+		keyword:          foldedPrefixMarker(g.Keyword),
+		typ:              prefixMarker(g.Type),
+		date: regexp.MustCompile(`^` + regexp.QuoteMeta(g.Date) +
+			`\p{Zs}*(\pN{4}(?:[-/]\pN{2}(?:[-/]\pN{2})?)?)\p{Zs}*$`),
+		translation:       prefixMarker(g.Translation),
+		original:          prefixMarker(g.Original),
+		language:          prefixMarker(g.Language),
+		citationNoteBlock: blockMarker(g.CitationNote, g.BlockOpen),
+		quoteNoteBlock:    blockMarker(g.QuoteNote, g.BlockOpen),
+		supplementBlock:   blockMarker(g.Supplement, g.BlockOpen),
+		translationBlock:  blockMarker(g.Translation, g.BlockOpen),
+		originalBlock:     blockMarker(g.Original, g.BlockOpen),
+		blockClose:        regexp.MustCompile(`^` + regexp.QuoteMeta(g.BlockClose) + `$`),
+	}
+}
+
+// The default grammar, used where no grammar is supplied.
+var defaultGrammar = Grammar{}.compile()
@@ -0,0 +1,135 @@
+// identifier.go
+//
+// DOIs, ISBNs, and ISSNs found in citations.
+//
+// Identifiers are normalized before they are stored: DOIs lose any resolver
+// prefix, ISBNs lose hyphens and spaces, and ISSNs are written with a single
+// hyphen. ISBN and ISSN check digits are validated; an identifier which fails
+// its checksum, or an ISBN of the wrong length, is usually a typo, so it is
+// reported rather than stored.
+package qris
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var doiPattern = regexp.MustCompile(
+	`(?i)(?:\bhttps?://(?:dx\.)?doi\.org/|\bdoi:?\p{Zs}*)?\b(10\.\pN{4,9}/[^\p{Zs}]+)`)
+
+// An ISBN follows an "ISBN" label, or is an unlabeled ISBN-13.
+var isbnPattern = regexp.MustCompile(
+	`(?i)\bISBN(?:-?1[03])?:?\p{Zs}*([0-9](?:[\p{Pd}\p{Zs}]?[0-9]){8,11}[\p{Pd}\p{Zs}]?[0-9Xx])\b|` +
+		`\b(97[89](?:\p{Pd}?[0-9]){10})\b`)
+var issnPattern = regexp.MustCompile(`(?i)\bISSN:?\p{Zs}*(\pN{4})\p{Pd}?(\pN{3}[\pNXx])\b`)
+
+// `trimIdentifier` removes punctuation which ends the citation, or which
+// encloses an identifier, from the end of `s`.
+func trimIdentifier(s string) string {
+	return strings.TrimRight(s, ".,;:)]}>”\"")
+}
+
+// `stripIdentifiers` removes identifiers from the citation body `b` so that
+// their digits are not mistaken for years, volumes, or publishers.
+func stripIdentifiers(b string) string {
+	for _, re := range []*regexp.Regexp{doiPattern, isbnPattern, issnPattern} {
+		b = re.ReplaceAllString(b, "")
+	}
+	return b
+}
+
+// `normalizeIsbn` returns `s` without hyphens or spaces, with an upper
+// case check digit.
+func normalizeIsbn(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if r >= '0' && r <= '9' || r == 'X' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// `digitValue` returns the value of an ISBN or ISSN digit; "X" is 10.
+func digitValue(r byte) int {
+	if r == 'X' {
+		return 10
+	}
+	return int(r - '0')
+}
+
+// `validIsbn` checks the check digit of a normalized ISBN-10 or ISBN-13.
+func validIsbn(isbn string) bool {
+	sum := 0
+	switch len(isbn) {
+	case 10:
+		for i := 0; i < 10; i++ {
+			if isbn[i] == 'X' && i != 9 {
+				return false
+			}
+			sum += (10 - i) * digitValue(isbn[i])
+		}
+		return sum%11 == 0
+	case 13:
+		for i := 0; i < 13; i++ {
+			if isbn[i] == 'X' {
+				return false
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += weight * digitValue(isbn[i])
+		}
+		return sum%10 == 0
+	default:
+		return false
+	}
+}
+
+// `validIssn` checks the check digit of an ISSN of the form "1234-567X".
+func validIssn(issn string) bool {
+	digits := strings.Replace(issn, "-", "", 1)
+	if len(digits) != 8 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 8; i++ {
+		if digits[i] == 'X' && i != 7 {
+			return false
+		}
+		sum += (8 - i) * digitValue(digits[i])
+	}
+	return sum%11 == 0
+}
+
+// `parseIdentifiers` fills the `DOI`, `ISBN`, and `ISSN` fields of `c` with
+// the first valid identifier of each kind in its body, and returns an error
+// for each identifier which fails its checksum.
+func parseIdentifiers(c *Citation) []error {
+	var errs []error
+	if m := doiPattern.FindStringSubmatch(c.Body); m != nil {
+		c.DOI = trimIdentifier(m[1])
+	}
+	for _, m := range isbnPattern.FindAllStringSubmatch(c.Body, -1) {
+		raw := m[1] + m[2]
+		isbn := normalizeIsbn(raw)
+		if len(isbn) != 10 && len(isbn) != 13 {
+			errs = append(errs, fmt.Errorf("ISBN %s is malformed; an ISBN has 10 or 13 digits", raw))
+		} else if !validIsbn(isbn) {
+			errs = append(errs, fmt.Errorf("ISBN %s fails its checksum", raw))
+		} else if c.ISBN == "" {
+			c.ISBN = isbn
+		}
+	}
+	for _, m := range issnPattern.FindAllStringSubmatch(c.Body, -1) {
+		issn := m[1] + "-" + strings.ToUpper(m[2])
+		if !validIssn(issn) {
+			errs = append(errs, fmt.Errorf("ISSN %s fails its checksum", issn))
+		} else if c.ISSN == "" {
+			c.ISSN = issn
+		}
+	}
+	return errs
+}
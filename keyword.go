@@ -0,0 +1,71 @@
+// keyword.go
+//
+// Keyword lists and hierarchical keywords.
+//
+// A keyword line may hold several keywords separated by any of the keyword
+// separators of the `Grammar`, ";" by default: "^S: self; memory". A keyword
+// may name its place in a hierarchy with ">", e.g., "Psychology > Self".
+// With `OutOpts.KeywordAncestors` each ancestor of a hierarchical keyword is
+// also written as a keyword of its own: "Psychology", "Psychology > Self".
+package qris
+
+import "strings"
+
+// The separator of the levels of a hierarchical keyword.
+const keywordLevel = ">"
+
+// `normalizeKeyword` trims the levels of keyword `kw` and joins them with
+// single spaces around `keywordLevel`; empty levels are dropped.
+func normalizeKeyword(kw string) string {
+	var levels []string
+	for _, l := range strings.Split(kw, keywordLevel) {
+		if l = strings.Join(strings.Fields(l), " "); l != "" {
+			levels = append(levels, l)
+		}
+	}
+	return strings.Join(levels, " "+keywordLevel+" ")
+}
+
+// `splitKeywords` splits the keyword list `b` on any rune of `separators`.
+func splitKeywords(b, separators string) []string {
+	var kws []string
+	parts := strings.FieldsFunc(b, func(r rune) bool {
+		return strings.ContainsRune(separators, r)
+	})
+	for _, p := range parts {
+		if kw := normalizeKeyword(p); kw != "" {
+			kws = append(kws, kw)
+		}
+	}
+	return kws
+}
+
+// `keywordAncestors` returns `kws` with the ancestors of each hierarchical
+// keyword before it.
+func keywordAncestors(kws []string) []string {
+	var all []string
+	for _, kw := range kws {
+		levels := strings.Split(kw, " "+keywordLevel+" ")
+		for i := 1; i < len(levels); i++ {
+			all = append(all, strings.Join(levels[:i], " "+keywordLevel+" "))
+		}
+		all = append(all, kw)
+	}
+	return all
+}
+
+// `mergeKeywords` returns the keywords of `lists` in order, without
+// repetitions.
+func mergeKeywords(lists ...[]string) []string {
+	var kws []string
+	seen := map[string]bool{}
+	for _, l := range lists {
+		for _, kw := range l {
+			if !seen[kw] {
+				seen[kw] = true
+				kws = append(kws, kw)
+			}
+		}
+	}
+	return kws
+}
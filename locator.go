@@ -0,0 +1,106 @@
+// locator.go
+//
+// Page locators parsed from the page numbers of quotes.
+package qris
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A page group: one page, or two pages separated by a comma, dashes, or
+// spaces. Pages are arabic or roman numerals and may be followed by "f" or
+// "ff" to include the following pages.
+var locatorParts = regexp.MustCompile(
+	`^(\pN+|[ivxlcdmIVXLCDM]+|\?)(ff?)?(?:\p{Zs}*(,|\p{Pd}+|\p{Zs})\p{Zs}*(\pN+|[ivxlcdmIVXLCDM]+|\?)(ff?)?)?$`)
+var romanNumeral = regexp.MustCompile(
+	`^(?i)m{0,3}(?:cm|cd|d?c{0,3})(?:xc|xl|l?x{0,3})(?:ix|iv|v?i{0,3})$`)
+
+var errPageUnknown = errors.New("page number unknown")
+var errPageMalformed = errors.New("malformed page number")
+var errPageRoman = errors.New("invalid roman numeral in page number")
+var errPageMixed = errors.New("page range mixes roman and arabic numerals")
+var errPageOrder = errors.New("page range ends before it starts")
+
+// A `Locator` is the normalized form of the page group of a quote.
+// `List` is true when pages were separated by a comma or spaces rather than
+// a dash; `Following` holds an "f" or "ff" suffix.
+type Locator struct {
+	Start     string
+	End       string
+	List      bool
+	Following string
+}
+
+// `String` returns the locator with an en dash for ranges, e.g., "131–141",
+// "5, 6", or "22ff".
+func (l Locator) String() string {
+	switch {
+	case l.End == "":
+		return l.Start + l.Following
+	case l.List:
+		return l.Start + ", " + l.End + l.Following
+	default:
+		return l.Start + "–" + l.End + l.Following
+	}
+}
+
+// `Pages` returns the start and end pages for the `SP` and `EP` fields. The
+// "f" or "ff" suffix is kept on the last page. A list of pages is not a
+// range, so the whole list is the start page and there is no end page.
+func (l Locator) Pages() (string, string) {
+	if l.End == "" || l.List {
+		return l.String(), ""
+	}
+	return l.Start, l.End + l.Following
+}
+
+func isRoman(s string) bool {
+	return s != "" && !isDigits(s) && romanNumeral.MatchString(s)
+}
+
+// `parseLocator` parses the page group `page` returned by `getQuote`.
+// Abbreviated ranges are expanded, e.g., 131-41 becomes 131–141.
+func parseLocator(page string) (Locator, error) {
+	var loc Locator
+	page = strings.TrimSpace(page)
+	if page == "" || page == "?" {
+		return loc, errPageUnknown
+	}
+	m := locatorParts.FindStringSubmatch(page)
+	if m == nil {
+		return loc, errPageMalformed
+	}
+	start, end := m[1], m[4]
+	if start == "?" || end == "?" {
+		return loc, errPageUnknown
+	}
+	if !isDigits(start) && !isRoman(start) ||
+		end != "" && !isDigits(end) && !isRoman(end) {
+		return loc, errPageRoman
+	}
+	loc.Start = start
+	loc.Following = m[2]
+	if end == "" {
+		return loc, nil
+	}
+	// In a range such as "41ff – 42ff" the suffix of the last page applies.
+	if m[5] != "" {
+		loc.Following = m[5]
+	}
+	if isDigits(start) != isDigits(end) {
+		return loc, errPageMixed
+	}
+	loc.List = m[3] == "," || strings.TrimSpace(m[3]) == ""
+	loc.End = expandPage(start, end)
+	if isDigits(start) {
+		s, _ := strconv.Atoi(start)
+		e, _ := strconv.Atoi(loc.End)
+		if e < s {
+			return loc, errPageOrder
+		}
+	}
+	return loc, nil
+}
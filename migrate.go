@@ -0,0 +1,327 @@
+// migrate.go
+//
+// Migrate the supplement lines of quote files to the canonical form of the
+// grammar: from the suffix form, "text %%", to the prefix form, "%% text",
+// if the grammar sets "supplement.canonical = prefix", and from the prefix
+// form to the suffix form otherwise.
+//
+// A .txt quote file is rewritten in place; only supplement lines change, and
+// their line endings are kept. A .docx quote file is not changed: a corrected
+// copy is written alongside it, in which only the text of the supplement
+// paragraphs changes. Styles, run formatting, hyperlinks, and every other
+// part of the file are copied as they are.
+package qris
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// `MigratedPath` returns the path of the corrected copy of the .docx quote
+// file at `fpath`.
+func MigratedPath(fpath string) string {
+	return strings.TrimSuffix(fpath, ".docx") + migratedSuffix
+}
+
+// `migrateSupplement` rewrites the supplement line `b` in the canonical form
+// of `gr`.
+func migrateSupplement(b string, gr *grammar) string {
+	supp := getSupplement(strings.TrimSpace(b), gr)
+	if gr.SupplementPrefix {
+		return gr.Supplement + " " + supp
+	}
+	return supp + " " + gr.Supplement
+}
+
+// `MigrateSupplements` rewrites the supplement lines of the quote file at
+// `fpath` in the canonical form of the grammar of `inOpts` and returns the
+// number of lines changed. A .txt file is rewritten, and a .docx file gets a
+// corrected copy at `MigratedPath(fpath)`, only if a line changes.
+func MigrateSupplements(fpath string, inOpts InOpts) (int, error) {
+	pf := ProcessFile(fpath, inOpts)
+	gr := pf.Grammar.compile()
+	others := pf.prefixSupps
+	if gr.SupplementPrefix {
+		others = pf.suffixSupps
+	}
+	change := map[int]bool{}
+	for _, n := range others {
+		change[n] = true
+	}
+	if len(change) == 0 {
+		return 0, nil
+	}
+
+	if isDocxFile(fpath) {
+		return migrateDocx(fpath, MigratedPath(fpath), change, gr)
+	}
+
+	lines := map[int]string{}
+	for _, l := range getLines(fpath) {
+		if change[l.LineNo] {
+			lines[l.LineNo] = migrateSupplement(l.Body, gr)
+		}
+	}
+	return len(change), rewriteTxtLines(fpath, lines)
+}
+
+// A `docxText` is one piece of the text of a paragraph in word/document.xml:
+// the character data of a `w:t` element, or a `w:tab` or `w:noBreakHyphen`
+// element, which `DocxToLines` reads as a tab or a hyphen and which cannot
+// be edited.
+type docxText struct {
+	tag        [2]int // offsets of the start tag of a `w:t` element
+	start, end int    // offsets of the character data
+	text       string
+	fixed      bool
+}
+
+// `docxParagraphs` returns the text of each paragraph of the body of the
+// document part `doc`, numbered as the lines of `DocxToLines`.
+func docxParagraphs(doc []byte) ([][]docxText, error) {
+	var ps [][]docxText
+	var stack []string // local names of the open elements
+	var tagStart int
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		offset := int(d.InputOffset())
+		tok, err := d.Token()
+		if err == io.EOF {
+			return ps, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The text of a paragraph is in the runs of a body paragraph,
+		// or of a hyperlink in one, as `DocxToLines` reads it.
+		inRun := func(depth int) bool {
+			n := len(stack) - depth
+			return n >= 4 && stack[n-1] == "r" && (stack[n-2] == "p" && n == 4 ||
+				stack[n-2] == "hyperlink" && stack[n-3] == "p" && n == 5)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			switch {
+			case len(stack) == 3 && t.Name.Local == "p" && stack[1] == "body":
+				ps = append(ps, nil)
+			case t.Name.Local == "t" && inRun(1):
+				tagStart = offset
+			case t.Name.Local == "tab" && inRun(1):
+				ps[len(ps)-1] = append(ps[len(ps)-1], docxText{text: "\t", fixed: true})
+			case t.Name.Local == "noBreakHyphen" && inRun(1):
+				ps[len(ps)-1] = append(ps[len(ps)-1], docxText{text: "-", fixed: true})
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 && stack[len(stack)-1] == "t" && inRun(1) {
+				ps[len(ps)-1] = append(ps[len(ps)-1], docxText{
+					tag:   [2]int{tagStart, offset},
+					start: offset,
+					end:   int(d.InputOffset()),
+					text:  string(t),
+				})
+			}
+		}
+	}
+}
+
+// `trimDocxText` removes white space from the end, or the start if `start`
+// is true, of the text `ts`. Fixed tabs are skipped.
+func trimDocxText(ts []docxText, start bool) {
+	for i := range ts {
+		t := &ts[len(ts)-1-i]
+		if start {
+			t = &ts[i]
+		}
+		if t.fixed {
+			if strings.TrimSpace(t.text) == "" {
+				continue
+			}
+			return
+		}
+		if start {
+			t.text = strings.TrimLeftFunc(t.text, unicode.IsSpace)
+		} else {
+			t.text = strings.TrimRightFunc(t.text, unicode.IsSpace)
+		}
+		if t.text != "" {
+			return
+		}
+	}
+}
+
+// `firstDocxText` returns the first piece of `ts` with text, or nil.
+func firstDocxText(ts []docxText) *docxText {
+	for i := range ts {
+		if ts[i].text != "" {
+			return &ts[i]
+		}
+	}
+	return nil
+}
+
+// `lastDocxText` returns the last piece of `ts` with text, or nil.
+func lastDocxText(ts []docxText) *docxText {
+	for i := len(ts) - 1; i >= 0; i-- {
+		if ts[i].text != "" {
+			return &ts[i]
+		}
+	}
+	return nil
+}
+
+// `prefixDocxSupplement` moves the suffix supplement marker `m` of the
+// paragraph text `ts` to its start, and returns false if the marker is not
+// at the end of editable text.
+func prefixDocxSupplement(ts []docxText, m string) bool {
+	trimDocxText(ts, false)
+	// A marker ending in a letter may be followed by a period; see
+	// `suffixMarker`.
+	if r := []rune(m); unicode.IsLetter(r[len(r)-1]) {
+		if t := lastDocxText(ts); t != nil && !t.fixed {
+			t.text = strings.TrimSuffix(t.text, ".")
+		}
+	}
+	for rest := m; rest != ""; {
+		t := lastDocxText(ts)
+		if t == nil || t.fixed {
+			return false
+		}
+		n := min(len(rest), len(t.text))
+		if !strings.HasSuffix(t.text, rest[len(rest)-n:]) {
+			return false
+		}
+		t.text, rest = t.text[:len(t.text)-n], rest[:len(rest)-n]
+	}
+	trimDocxText(ts, false)
+	trimDocxText(ts, true)
+	for i := range ts {
+		if !ts[i].fixed && ts[i].text != "" {
+			ts[i].text = m + " " + ts[i].text
+			return true
+		}
+	}
+	return false
+}
+
+// `suffixDocxSupplement` moves the prefix supplement marker `m` of the
+// paragraph text `ts` to its end, and returns false if the marker is not at
+// the start of editable text or the text does not end in editable text.
+func suffixDocxSupplement(ts []docxText, m string) bool {
+	trimDocxText(ts, true)
+	for rest := m; rest != ""; {
+		t := firstDocxText(ts)
+		if t == nil || t.fixed {
+			return false
+		}
+		n := min(len(rest), len(t.text))
+		if !strings.HasPrefix(t.text, rest[:n]) {
+			return false
+		}
+		t.text, rest = t.text[n:], rest[n:]
+	}
+	trimDocxText(ts, true)
+	trimDocxText(ts, false)
+	t := lastDocxText(ts)
+	if t == nil || t.fixed {
+		return false
+	}
+	t.text += " " + m
+	return true
+}
+
+// `rewriteDocxText` returns `doc` with the character data of the `w:t`
+// elements of `ts` replaced by their text. Text with white space at its
+// ends is marked to be preserved.
+func rewriteDocxText(doc []byte, ts []docxText) []byte {
+	var b bytes.Buffer
+	last := 0
+	for _, t := range ts {
+		if t.fixed {
+			continue
+		}
+		startTag := string(doc[t.tag[0]:t.tag[1]])
+		if strings.TrimSpace(t.text) != t.text && !strings.Contains(startTag, "xml:space") {
+			b.Write(doc[last:t.tag[0]])
+			b.WriteString(strings.TrimSuffix(startTag, ">") + ` xml:space="preserve">`)
+			last = t.tag[1]
+		}
+		b.Write(doc[last:t.start])
+		b.WriteString(xmlText(t.text))
+		last = t.end
+	}
+	b.Write(doc[last:])
+	return b.Bytes()
+}
+
+// `migrateDocx` writes a copy of the .docx file `src` to `dst` in which the
+// supplement markers of the paragraphs numbered by the keys of `change` are
+// moved to the canonical position of `gr`, and returns the number of
+// paragraphs changed.
+func migrateDocx(src, dst string, change map[int]bool, gr *grammar) (int, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	n := 0
+	for _, f := range r.File {
+		if f.Name != "word/document.xml" {
+			if err := zw.Copy(f); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return 0, err
+		}
+		doc, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return 0, err
+		}
+		ps, err := docxParagraphs(doc)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", src, err)
+		}
+		move := suffixDocxSupplement
+		if gr.SupplementPrefix {
+			move = prefixDocxSupplement
+		}
+		var edits []docxText
+		for i, ts := range ps {
+			if change[i] && move(ts, gr.Supplement) {
+				edits = append(edits, ts...)
+				n++
+			}
+		}
+		h := f.FileHeader
+		w, err := zw.CreateHeader(&h)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(rewriteDocxText(doc, edits)); err != nil {
+			return 0, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	return n, out.Close()
+}
@@ -9,16 +9,8 @@ import (
 )
 
 // Markup Tokens
+// The markers of markup lines are given by a `Grammar`; see grammar.go.
 var blankLine = regexp.MustCompile(`^[\p{Zs}\t]*$`)
-var commentLine = regexp.MustCompile(`^##`)
-var discardLine = regexp.MustCompile(`^__`)
-var citationLine = regexp.MustCompile(`^<\$>`)
-var citationNoteLine = regexp.MustCompile(`-nb\.?$`)
-var mlqLine = regexp.MustCompile(`^///`)
-var quoteNoteLine = regexp.MustCompile(`jmr\.?$`)
-var quoteAuthorLine = regexp.MustCompile(`^>>>`)
-var supplementLine = regexp.MustCompile(`%%$`)
-var keywordLine = regexp.MustCompile(`^\^[sS]:`)
 var urlLine = regexp.MustCompile(`^https?://`)
 
 // A quote end is either tab-delimited pp., or space-delimited pp. with
@@ -30,10 +22,19 @@ var quoteLineAlt = regexp.MustCompile(`\p{Zs}{3,}?[pP]{1,2}\.?\p{Zs}+[\pNiIvVxXl
 var citationName = regexp.MustCompile(`^[^“"{]*`)
 var finalPeriod = regexp.MustCompile(`\.$`)
 var nameInitialPeriod = regexp.MustCompile(`[\p{Zs}.]{1}[\pL]{1}\.$`)
-var citationFamilyName = regexp.MustCompile(`^[^,]*`)
 var citationYear = regexp.MustCompile(`[^\pN]\pN{4}\pL?[^\pN]`)
 var citationYearAlt = regexp.MustCompile(`[^\pN]\pN{4}\pL?[\pP]?$`)
-var citationYearTrim = regexp.MustCompile(`\pN{4}\pL?`)
+var citationYearTrim = regexp.MustCompile(`(\pN{4})(\pL?)`)
+
+// Reprints give the original year in brackets or parentheses, or before a
+// slash: "[1961] 1988", "1988 [1961]", "1964 (1957)", "1951/2004".
+var reprintYearBefore = regexp.MustCompile(`\[(\pN{4})\]\p{Zs}*(\pN{4})(\pL?)\b`)
+var reprintYearAfter = regexp.MustCompile(`\b(\pN{4})(\pL?)\p{Zs}*[\[(](\pN{4})[\])]`)
+var reprintYearSlash = regexp.MustCompile(`\b(\pN{4})\p{Zs}*/\p{Zs}*(\pN{4})(\pL?)\b`)
+
+// Citations of works without a publication year.
+var noDate = regexp.MustCompile(
+	`(?i)(?:^|[\p{Zs}(\[,.])(n\.?\p{Zs}?d\.?|forthcoming|in\p{Zs}+press)(?:$|[\p{Zs})\],.;:])`)
 
 // Quote Line Information
 var quotePage = regexp.MustCompile(
@@ -43,14 +44,34 @@ var pageNumber = regexp.MustCompile(
 
 type ParseState int
 
+// In strict mode a file begins `InPreamble` rather than at `Start`, and
+// every citation must begin with the citation marker. The block states
+// collect the lines of a note or supplement until the block is closed.
+// New states are added at the end, so that the values of the others do not
+// change.
 const (
 	Start ParseState = iota
 	InSource
 	InMultiQuote
 	InQuote
 	Finished
+	InPreamble
+	InCitationNote
+	InQuoteNote
+	InSupplement
+	InTranslation
+	InOriginal
 )
 
+// `isBlock` returns true if `ps` collects the lines of a block.
+func (ps ParseState) isBlock() bool {
+	switch ps {
+	case InCitationNote, InQuoteNote, InSupplement, InTranslation, InOriginal:
+		return true
+	}
+	return false
+}
+
 type LineType int
 
 const (
@@ -67,6 +88,18 @@ const (
 	KeywordLn
 	SupplementLn
 	UrlLn
+	TypeLn
+	DateLn
+	CitationNoteBlockLn
+	QuoteNoteBlockLn
+	SupplementBlockLn
+	BlockLn
+	BlockEndLn
+	TranslationLn
+	OriginalLn
+	LanguageLn
+	TranslationBlockLn
+	OriginalBlockLn
 )
 
 func (lt LineType) String() string {
@@ -98,34 +131,94 @@ func (lt LineType) String() string {
 		s = "SupplementLn"
 	case UrlLn:
 		s = "UrlLn"
+	case TypeLn:
+		s = "TypeLn"
+	case DateLn:
+		s = "DateLn"
+	case CitationNoteBlockLn:
+		s = "CitationNoteBlockLn"
+	case QuoteNoteBlockLn:
+		s = "QuoteNoteBlockLn"
+	case SupplementBlockLn:
+		s = "SupplementBlockLn"
+	case BlockLn:
+		s = "BlockLn"
+	case BlockEndLn:
+		s = "BlockEndLn"
+	case TranslationLn:
+		s = "TranslationLn"
+	case OriginalLn:
+		s = "OriginalLn"
+	case LanguageLn:
+		s = "LanguageLn"
+	case TranslationBlockLn:
+		s = "TranslationBlockLn"
+	case OriginalBlockLn:
+		s = "OriginalBlockLn"
 	}
 	return s
 }
 
-func determineLineType(body string, ps ParseState) LineType {
+func determineLineType(body string, ps ParseState, gr *grammar) LineType {
+	// Within a block every line but a comment, the closing line, or a
+	// citation, which ends a block left open, is text.
+	if ps.isBlock() {
+		switch {
+		case blankLine.MatchString(body):
+			return BlankLn
+		case gr.comment.MatchString(body):
+			return CommentLn
+		case gr.blockClose.MatchString(body):
+			return BlockEndLn
+		case gr.citation.MatchString(body):
+			return CitationLn
+		default:
+			return BlockLn
+		}
+	}
 	switch {
 	case blankLine.MatchString(body) && ps != InMultiQuote:
 		return BlankLn
-	case commentLine.MatchString(body):
+	case gr.comment.MatchString(body):
 		return CommentLn
-	case discardLine.MatchString(body):
+	case gr.discard.MatchString(body):
 		return DiscardLn
-	case citationLine.MatchString(body) || ps == Start:
+	case gr.citation.MatchString(body) || ps == Start:
 		return CitationLn
-	case citationNoteLine.FindStringIndex(body) != nil:
+	case gr.citationNoteBlock.MatchString(body):
+		return CitationNoteBlockLn
+	case gr.quoteNoteBlock.MatchString(body):
+		return QuoteNoteBlockLn
+	case gr.supplementBlock.MatchString(body):
+		return SupplementBlockLn
+	case gr.translationBlock.MatchString(body):
+		return TranslationBlockLn
+	case gr.originalBlock.MatchString(body):
+		return OriginalBlockLn
+	case gr.citationNote.FindStringIndex(body) != nil:
 		return CitationNoteLn
 	case quoteLine.FindStringIndex(body) != nil ||
 		quoteLineAlt.FindStringIndex(body) != nil:
 		return QuoteLn
-	case mlqLine.MatchString(body):
+	case gr.multiQuote.MatchString(body):
 		return MultiQuoteLn
-	case quoteNoteLine.MatchString(body):
+	case gr.quoteNote.MatchString(body):
 		return QuoteNoteLn
-	case quoteAuthorLine.MatchString(body):
+	case gr.quoteAuthor.MatchString(body):
 		return QuoteAuthorLn
-	case keywordLine.MatchString(body):
+	case gr.keyword.MatchString(body):
 		return KeywordLn
-	case supplementLine.MatchString(body):
+	case gr.typ.MatchString(body):
+		return TypeLn
+	case gr.date.MatchString(body):
+		return DateLn
+	case gr.translation.MatchString(body):
+		return TranslationLn
+	case gr.original.MatchString(body):
+		return OriginalLn
+	case gr.language.MatchString(body):
+		return LanguageLn
+	case gr.supplement.MatchString(body) || gr.supplementPrefix.MatchString(body):
 		return SupplementLn
 	case urlLine.MatchString(body):
 		return UrlLn
@@ -134,27 +227,104 @@ func determineLineType(body string, ps ParseState) LineType {
 	}
 }
 
-func ProcessFile(fpath string) ParsedFile {
+// `ProcessFile` parses the quote file at `fpath` using the markup grammar of
+// `inOpts`.
+func ProcessFile(fpath string, inOpts InOpts) ParsedFile {
 	var pf ParsedFile
+	gr := inOpts.Grammar.compile()
 	curSrc := -1 // No sources yet.
 	curQte := -1 // No quotes yet.
+	var block []string
+	var blockStart Line // Opening line of the current block.
 	pf.Filepath = fpath
+	pf.Grammar = gr.Grammar
 	pf.State = Start
+	if inOpts.Strict {
+		pf.State = InPreamble
+	}
 	rls := getLines(fpath)
-	for _, l := range rls[1:] { // Always ignore first line of input file.
+	if !inOpts.NoTitle && len(rls) > 0 { // The first line is the title.
+		pf.Title = strings.TrimSpace(rls[0].Body)
+		rls = rls[1:]
+	}
+	// `openBlock` begins a block in state `ps` at line `l`, which matches
+	// `open`; a block closed on its opening line ends at once.
+	openBlock := func(l Line, open *regexp.Regexp, ps ParseState) {
+		var closed bool
+		block, closed = beginBlock(strings.TrimSpace(l.Body), open, gr)
+		blockStart, pf.State = l, ps
+		if closed {
+			pf.endBlock(block, curSrc, curQte)
+		}
+	}
+	for _, l := range rls {
 		body := strings.TrimSpace(l.Body)
-		lineType := determineLineType(body, pf.State)
+		lineType := determineLineType(body, pf.State, gr)
+		// Directives are comments beginning "##!"; see directive.go.
+		if lineType == CommentLn {
+			if key, value, ok := getDirective(body, gr); ok {
+				gr = pf.directive(l, key, value, gr)
+				continue
+			}
+		}
 		if lineType == CommentLn || lineType == BlankLn { // Skipped lines.
 			continue
 		}
-		if lineType == DiscardLn ||
-			(lineType == UnknownLn && pf.State != InMultiQuote) {
-			pf.Discards = append(pf.Discards, l)
+		if lineType == DiscardLn {
+			pf.discard(diagnose(l, SevInfo, CodeMarkedDiscard,
+				"line marked for discard with '"+gr.Discard+"'"))
+		}
+		if lineType == UnknownLn && pf.State != InMultiQuote && pf.State != InPreamble {
+			pf.discard(explainUnknown(l, pf.State, gr))
+		}
+		if d, ok := misplaced(l, lineType, pf.State); ok {
+			pf.discard(d)
+			continue
+		}
+		// A reference type override applies to the current source.
+		if lineType == TypeLn && (pf.State == InSource || pf.State == InQuote) {
+			if ty := getType(gr.typ.ReplaceAllString(body, "")); ty != "" {
+				pf.Sources[curSrc].Citation.Type = ty
+			} else {
+				pf.discard(diagnose(l, SevError, CodeUnknownType,
+					"reference type override names no RIS reference type, e.g., BOOK or CHAP"))
+			}
+			continue
+		}
+		if lineType == DateLn && (pf.State == InSource || pf.State == InQuote) {
+			if d := getDate(body, gr); d != "" {
+				pf.Sources[curSrc].Citation.Date = d
+			} else {
+				pf.discard(diagnose(l, SevError, CodeBadDate,
+					"date line needs a date written YYYY-MM-DD, YYYY-MM, or YYYY"))
+			}
+			continue
 		}
 		switch pf.State {
+		case InPreamble:
+			if lineType == CitationLn {
+				pf.Sources = append(pf.Sources, getSource(gr.citation.ReplaceAllString(body, "")))
+				pf.checkCitation(l, pf.Sources[len(pf.Sources)-1].Citation)
+				curSrc += 1 // Added a source.
+				curQte = -1 // No quotes yet.
+				pf.State = InSource
+				break
+			}
+			if lineType != DiscardLn {
+				if d, ok := fixNearMiss(l, pf.State, gr, true); ok {
+					pf.Diagnostics = append(pf.Diagnostics, d)
+				}
+				pf.Preamble = append(pf.Preamble, l)
+			}
 		case Start:
 			if lineType == CitationLn {
-				pf.Sources = append(pf.Sources, getSource(body))
+				if !gr.citation.MatchString(body) {
+					if d, ok := fixNearMiss(l, pf.State, gr, true); ok {
+						pf.Diagnostics = append(pf.Diagnostics, d)
+					}
+				}
+				pf.Sources = append(pf.Sources, getSource(gr.citation.ReplaceAllString(body, "")))
+				pf.checkCitation(l, pf.Sources[len(pf.Sources)-1].Citation)
 				curSrc += 1 // Added a source.
 				curQte = -1 // No quotes yet.
 				pf.State = InSource
@@ -162,11 +332,34 @@ func ProcessFile(fpath string) ParsedFile {
 			}
 		case InSource:
 			if lineType == CitationNoteLn {
-				pf.Sources[curSrc].Citation.Note = getCitationNote(body)
+				pf.Sources[curSrc].Citation.Note = getCitationNote(body, gr)
+				break
+			}
+			if lineType == CitationNoteBlockLn {
+				openBlock(l, gr.citationNoteBlock, InCitationNote)
+				break
+			}
+			// Source-level values are inherited by each quote of the source.
+			if lineType == QuoteAuthorLn {
+				pf.Sources[curSrc].Auth = getQuoteAuthor(body, gr)
+				break
+			}
+			if lineType == KeywordLn {
+				pf.Sources[curSrc].Keywords =
+					append(pf.Sources[curSrc].Keywords, getKeywords(body, gr)...)
+				break
+			}
+			if lineType == UrlLn {
+				pf.Sources[curSrc].Url = getUrl(body)
+				break
+			}
+			if lineType == LanguageLn {
+				pf.Sources[curSrc].Lang = getMarked(body, gr.language)
 				break
 			}
 			if lineType == QuoteLn {
-				b, p := getQuote(body)
+				b, p := getQuote(body, gr)
+				pf.checkPage(l, p)
 				pf.Sources[curSrc].Quotes =
 					append(pf.Sources[curSrc].Quotes, Quote{Body: []string{b}, Page: p})
 				curQte += 1 // Added a quote.
@@ -174,7 +367,7 @@ func ProcessFile(fpath string) ParsedFile {
 				break
 			}
 			if lineType == MultiQuoteLn {
-				b := beginMultiQuote(body)
+				b := beginMultiQuote(body, gr)
 				pf.Sources[curSrc].Quotes =
 					append(pf.Sources[curSrc].Quotes, Quote{Body: []string{b}})
 				curQte += 1 // Added a quote.
@@ -183,7 +376,8 @@ func ProcessFile(fpath string) ParsedFile {
 			}
 		case InMultiQuote:
 			if lineType == QuoteLn { // This line ends a multi-line quote.
-				b, p := getQuote(body)
+				b, p := getQuote(body, gr)
+				pf.checkPage(l, p)
 				pf.Sources[curSrc].Quotes[curQte].Body =
 					append(pf.Sources[curSrc].Quotes[curQte].Body, b)
 				pf.Sources[curSrc].Quotes[curQte].Page = p
@@ -195,14 +389,16 @@ func ProcessFile(fpath string) ParsedFile {
 				append(pf.Sources[curSrc].Quotes[curQte].Body, strings.TrimSpace(body))
 		case InQuote:
 			if lineType == CitationLn {
-				pf.Sources = append(pf.Sources, getSource(body))
+				pf.Sources = append(pf.Sources, getSource(gr.citation.ReplaceAllString(body, "")))
+				pf.checkCitation(l, pf.Sources[len(pf.Sources)-1].Citation)
 				curSrc += 1 // Added a source.
 				curQte = -1 // No quotes yet.
 				pf.State = InSource
 				break
 			}
 			if lineType == QuoteLn {
-				b, p := getQuote(body)
+				b, p := getQuote(body, gr)
+				pf.checkPage(l, p)
 				pf.Sources[curSrc].Quotes =
 					append(pf.Sources[curSrc].Quotes, Quote{Body: []string{b}, Page: p})
 				curQte += 1 // Added a quote.
@@ -210,7 +406,7 @@ func ProcessFile(fpath string) ParsedFile {
 				break
 			}
 			if lineType == MultiQuoteLn {
-				b := beginMultiQuote(body)
+				b := beginMultiQuote(body, gr)
 				pf.Sources[curSrc].Quotes =
 					append(pf.Sources[curSrc].Quotes, Quote{Body: []string{b}})
 				curQte += 1 // Added a quote.
@@ -218,35 +414,148 @@ func ProcessFile(fpath string) ParsedFile {
 				break
 			}
 			if lineType == QuoteNoteLn {
-				pf.Sources[curSrc].Quotes[curQte].Note = getNote(body)
+				pf.Sources[curSrc].Quotes[curQte].Notes =
+					append(pf.Sources[curSrc].Quotes[curQte].Notes, getNote(body))
 			}
 			if lineType == QuoteAuthorLn {
-				pf.Sources[curSrc].Quotes[curQte].Auth = getQuoteAuthor(body)
+				pf.Sources[curSrc].Quotes[curQte].Auth = getQuoteAuthor(body, gr)
 			}
 			if lineType == KeywordLn {
-				pf.Sources[curSrc].Quotes[curQte].Keyword = getKeyword(body)
+				pf.Sources[curSrc].Quotes[curQte].Keywords =
+					append(pf.Sources[curSrc].Quotes[curQte].Keywords, getKeywords(body, gr)...)
 			}
 			if lineType == SupplementLn {
 				pf.Sources[curSrc].Quotes[curQte].Supp =
-					append(pf.Sources[curSrc].Quotes[curQte].Supp, getSupplement(body))
+					append(pf.Sources[curSrc].Quotes[curQte].Supp, getSupplement(body, gr))
+				if gr.supplementPrefix.MatchString(body) {
+					pf.prefixSupps = append(pf.prefixSupps, l.LineNo)
+				} else {
+					pf.suffixSupps = append(pf.suffixSupps, l.LineNo)
+				}
 			}
 			if lineType == UrlLn {
 				pf.Sources[curSrc].Quotes[curQte].Url = getUrl(body)
 			}
+			if lineType == QuoteNoteBlockLn {
+				openBlock(l, gr.quoteNoteBlock, InQuoteNote)
+			}
+			if lineType == SupplementBlockLn {
+				openBlock(l, gr.supplementBlock, InSupplement)
+			}
+			if lineType == TranslationLn {
+				pf.Sources[curSrc].Quotes[curQte].Translation = getMarked(body, gr.translation)
+			}
+			if lineType == OriginalLn {
+				pf.Sources[curSrc].Quotes[curQte].Original = getMarked(body, gr.original)
+			}
+			if lineType == LanguageLn {
+				pf.Sources[curSrc].Quotes[curQte].Lang = getMarked(body, gr.language)
+			}
+			if lineType == TranslationBlockLn {
+				openBlock(l, gr.translationBlock, InTranslation)
+			}
+			if lineType == OriginalBlockLn {
+				openBlock(l, gr.originalBlock, InOriginal)
+			}
+		case InCitationNote, InQuoteNote, InSupplement, InTranslation, InOriginal:
+			if lineType == BlockLn {
+				block = append(block, body)
+				break
+			}
+			pf.endBlock(block, curSrc, curQte) // This line ends the block.
+			if lineType == CitationLn {
+				pf.warn(blockStart, CodeUnclosedBlock, "block is not closed; it ends at the next citation")
+				pf.Sources = append(pf.Sources, getSource(gr.citation.ReplaceAllString(body, "")))
+				pf.checkCitation(l, pf.Sources[len(pf.Sources)-1].Citation)
+				curSrc += 1 // Added a source.
+				curQte = -1 // No quotes yet.
+				pf.State = InSource
+			}
 		default: // Unrecognized state: discard line for review.
-			pf.Discards = append(pf.Discards, l)
+			pf.discard(diagnose(l, SevError, CodeUnexpectedLine, "line in an unexpected parse state"))
 		}
 	}
+	if pf.State.isBlock() {
+		pf.warn(blockStart, CodeUnclosedBlock, "block is not closed")
+		pf.endBlock(block, curSrc, curQte)
+	}
+	for i := range pf.Sources { // Keywords of directives apply to every source.
+		pf.Sources[i].Keywords = mergeKeywords(pf.keywords, pf.Sources[i].Keywords)
+	}
 	pf.State = Finished
 	return pf
 }
 
+// `beginBlock` returns the lines of a block opened by the line `b`, which
+// matches `open`; text following the opening marker is the first line. It
+// also returns true if the block is closed on the same line, e.g.,
+// "jmr{A short note}". A closing marker which matches an opening marker in
+// the text, as in "jmr{See {A Title}", does not close the block.
+func beginBlock(b string, open *regexp.Regexp, gr *grammar) ([]string, bool) {
+	first := strings.TrimSpace(open.ReplaceAllLiteralString(b, ""))
+	closed := false
+	if text, ok := strings.CutSuffix(first, gr.BlockClose); ok &&
+		strings.Count(text, gr.BlockOpen) == strings.Count(text, gr.BlockClose) {
+		first, closed = strings.TrimSpace(text), true
+	}
+	if first != "" {
+		return []string{first}, closed
+	}
+	return nil, closed
+}
+
+// `endBlock` stores the lines of a closed block, joined by newlines, and
+// returns to the state in which the block was opened.
+func (pf *ParsedFile) endBlock(block []string, curSrc, curQte int) {
+	text := strings.Join(block, "\n")
+	switch pf.State {
+	case InCitationNote:
+		pf.Sources[curSrc].Citation.Note = text
+		pf.State = InSource
+		return
+	case InQuoteNote:
+		if text != "" {
+			pf.Sources[curSrc].Quotes[curQte].Notes =
+				append(pf.Sources[curSrc].Quotes[curQte].Notes, text)
+		}
+	case InSupplement:
+		if text != "" {
+			pf.Sources[curSrc].Quotes[curQte].Supp =
+				append(pf.Sources[curSrc].Quotes[curQte].Supp, text)
+		}
+	case InTranslation:
+		pf.Sources[curSrc].Quotes[curQte].Translation = text
+	case InOriginal:
+		pf.Sources[curSrc].Quotes[curQte].Original = text
+	}
+	pf.State = InQuote
+}
+
+// `checkPage` records a warning if the page group `p` of the quote on line
+// `l` cannot be parsed as a `Locator`.
+func (pf *ParsedFile) checkPage(l Line, p string) {
+	if _, err := parseLocator(p); err != nil {
+		pf.warn(l, CodePageUnknown, err.Error())
+	}
+}
+
+// `checkCitation` records a warning if the citation `c` on line `l` has no
+// year, and for each identifier in `c` which fails its checksum.
+func (pf *ParsedFile) checkCitation(l Line, c Citation) {
+	if c.Year == "" {
+		pf.warn(l, CodeNoYear, "no year found in citation")
+	}
+	for _, err := range parseIdentifiers(&c) {
+		pf.warn(l, CodeInvalidId, err.Error())
+	}
+}
+
 // `isSkipLine` returns `true` if `l` should be ignored during processing,
 // or `false` otherwise.
 func isSkipLine(l Line, pf ParsedFile) bool {
 	body := l.Body
 	isSkip := false
-	if commentLine.MatchString(body) { // Always ignore comments.
+	if pf.Grammar.compile().comment.MatchString(body) { // Always ignore comments.
 		isSkip = true
 	}
 	if blankLine.MatchString(body) && pf.State != InMultiQuote { // Usually ignore blank lines.
@@ -255,36 +564,81 @@ func isSkipLine(l Line, pf ParsedFile) bool {
 	return isSkip
 }
 
+// `parseYear` returns the publication year of the citation body `b`, the
+// letter suffix which disambiguates works from the same year, and the year
+// of original publication of a reprint. Works without a year have the year
+// "n.d.", "forthcoming", or "in press"; the year is empty if none is found.
+func parseYear(b string) (year, suffix, orig string) {
+	b = strings.TrimRight(strings.TrimSpace(b), ".,;:")
+	if m := reprintYearBefore.FindStringSubmatch(b); m != nil {
+		return m[2], m[3], m[1]
+	}
+	if m := reprintYearAfter.FindStringSubmatch(b); m != nil {
+		return m[1], m[2], m[3]
+	}
+	if m := reprintYearSlash.FindStringSubmatch(b); m != nil {
+		return m[2], m[3], m[1]
+	}
+	y := citationYearAlt.FindString(b) // year at end of citation
+	if y == "" {
+		if m := noDate.FindStringSubmatch(b); m != nil {
+			label := strings.ToLower(m[1])
+			if strings.HasPrefix(label, "n") {
+				label = "n.d."
+			}
+			return strings.Join(strings.Fields(label), " "), "", ""
+		}
+		yearMatches := citationYear.FindAllString(b, -1) // year buried in citation
+		if len(yearMatches) > 0 {
+			y = yearMatches[len(yearMatches)-1]
+		}
+	}
+	if m := citationYearTrim.FindStringSubmatch(y); m != nil {
+		return m[1], m[2], ""
+	}
+	return "", "", ""
+}
+
 func getSource(b string) Source {
-	tb := citationLine.ReplaceAllString(b, "") // trim `citationLine` token
-	tb = strings.TrimSpace(tb)
+	tb := strings.TrimSpace(b) // the citation marker is removed by `ProcessFile`
 	name := strings.TrimSpace(citationName.FindString(tb))
 	if !nameInitialPeriod.MatchString(name) {
 		name = finalPeriod.ReplaceAllString(name, "")
 	}
-	year := citationYearAlt.FindString(tb) // year at end of citation
-	if year == "" {
-		yearMatches := citationYear.FindAllString(tb, -1) // year buried in citation
-		countMatches := len(yearMatches)
-		if countMatches > 0 {
-			year = yearMatches[countMatches-1]
-		}
-	}
-	year = citationYearTrim.FindString(year)
+	year, suffix, orig := parseYear(stripIdentifiers(tb)) // identifier digits are not years
 	cit := Citation{
-		Name: name,
-		Year: year,
-		Body: tb,
+		Name:       name,
+		Year:       year,
+		YearSuffix: suffix,
+		OrigYear:   orig,
+		Body:       tb,
+		Type:       classifyCitation(tb, name),
 	}
+	parseNames(&cit, name)
+	parseCitation(&cit)
+	parseIdentifiers(&cit) // checksum failures are reported by `checkCitation`
 	src := Source{Citation: cit}
 	return src
 }
 
-func getCitationNote(b string) string {
-	return strings.TrimSpace(citationNoteLine.ReplaceAllLiteralString(b, ""))
+// `getDate` returns the date of a `date:` line, or the empty string if it is
+// not a valid date.
+func getDate(b string, gr *grammar) string {
+	m := gr.date.FindStringSubmatch(b)
+	if m == nil {
+		return ""
+	}
+	if _, ok := ParseDate(m[1]); !ok {
+		return ""
+	}
+	return m[1]
+}
+
+func getCitationNote(b string, gr *grammar) string {
+	return strings.TrimSpace(gr.citationNote.ReplaceAllLiteralString(b, ""))
 }
 
-func getQuote(b string) (string, string) {
+func getQuote(b string, gr *grammar) (string, string) {
 	// Malformed page numbers are recorded using `pageUnknown`.
 	const pageUnknown = "?"
 	var page string
@@ -297,7 +651,7 @@ func getQuote(b string) (string, string) {
 	endMatch := b[endMatchIndices[0]:]
 
 	// Get quote body: single-line quote may begin with multi-quote token.
-	body := strings.TrimSpace(mlqLine.ReplaceAllLiteralString(bodyMatch, ""))
+	body := strings.TrimSpace(gr.multiQuote.ReplaceAllLiteralString(bodyMatch, ""))
 
 	// Split end into page and supplementary field
 	pageMatchIndices := quotePage.FindStringIndex(endMatch)
@@ -310,24 +664,32 @@ func getQuote(b string) (string, string) {
 	return body, page
 }
 
-func beginMultiQuote(b string) string {
-	return strings.TrimSpace(mlqLine.ReplaceAllLiteralString(b, ""))
+func beginMultiQuote(b string, gr *grammar) string {
+	return strings.TrimSpace(gr.multiQuote.ReplaceAllLiteralString(b, ""))
 }
 
 func getNote(b string) string {
 	return b
 }
 
-func getQuoteAuthor(b string) string {
-	return strings.TrimSpace(quoteAuthorLine.ReplaceAllString(b, ""))
+func getQuoteAuthor(b string, gr *grammar) string {
+	return strings.TrimSpace(gr.quoteAuthor.ReplaceAllString(b, ""))
+}
+
+// `getKeywords` returns the keywords of the keyword list `b`.
+func getKeywords(b string, gr *grammar) []string {
+	return splitKeywords(gr.keyword.ReplaceAllString(b, ""), gr.KeywordSeparators)
 }
 
-func getKeyword(b string) string {
-	return strings.TrimSpace(keywordLine.ReplaceAllString(b, ""))
+// `getMarked` returns the text of the prefixed line `b` without its marker.
+func getMarked(b string, marker *regexp.Regexp) string {
+	return strings.TrimSpace(marker.ReplaceAllLiteralString(b, ""))
 }
 
-func getSupplement(b string) string {
-	return strings.TrimSpace(supplementLine.ReplaceAllString(b, ""))
+// `getSupplement` removes the supplement marker from either end of `b`.
+func getSupplement(b string, gr *grammar) string {
+	b = gr.supplementPrefix.ReplaceAllLiteralString(b, "")
+	return strings.TrimSpace(gr.supplement.ReplaceAllLiteralString(b, ""))
 }
 
 func getUrl(b string) string {
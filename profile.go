@@ -0,0 +1,260 @@
+// profile.go
+//
+// RIS tag mapping profiles.
+//
+// A `Profile` assigns each `Field` of a `Citation` or `Quote` to the RIS tag
+// it is written to, or drops the field. The "endnote" profile reproduces the
+// layout qris has always written, in which several tags are repurposed so
+// that EndNote displays quotes usefully. The "standard" profile writes each
+// field to the tag defined for it by the RIS specification.
+package qris
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// A `Field` names a value which may be written to a RIS record.
+type Field string
+
+const (
+	FileId    Field = "file.id"    // input file name without extension
+	FileBatch Field = "file.batch" // name of the directory of the input file
+	FileDate  Field = "file.date"  // datestamp
+	FileTitle Field = "file.title" // title line of the input file
+
+	CitationBody       Field = "citation.body"
+	CitationAuthor     Field = "citation.author"
+	CitationEditor     Field = "citation.editor"
+	CitationTranslator Field = "citation.translator"
+	CitationYear       Field = "citation.year"
+	CitationYearSuffix Field = "citation.yearsuffix" // "e" of "1999e"; see `quoteFields`
+	CitationOrigYear   Field = "citation.origyear"   // original year of a reprint
+	CitationTitle      Field = "citation.title"
+	CitationJournal    Field = "citation.journal"   // container of a journal article
+	CitationContainer  Field = "citation.container" // any other container
+	CitationVolume     Field = "citation.volume"
+	CitationIssue      Field = "citation.issue"
+	CitationStartPage  Field = "citation.startpage"
+	CitationEndPage    Field = "citation.endpage"
+	CitationPublisher  Field = "citation.publisher"
+	CitationPlace      Field = "citation.place"
+	CitationNote       Field = "citation.note"
+	CitationDoi        Field = "citation.doi"
+	CitationIsbn       Field = "citation.isbn"
+	CitationIssn       Field = "citation.issn"
+
+	QuoteId          Field = "quote.id" // stable record ID; see `quoteId`
+	QuoteAuthor      Field = "quote.author"
+	QuoteSource      Field = "quote.source" // "in Name" for a quote author
+	QuoteKeyword     Field = "quote.keyword"
+	QuoteBody        Field = "quote.body"
+	QuoteTranslation Field = "quote.translation"
+	QuoteOriginal    Field = "quote.original" // the quote in its original language
+	QuoteLanguage    Field = "quote.language"
+	QuoteStartPage   Field = "quote.startpage"
+	QuoteEndPage     Field = "quote.endpage"
+	QuoteSupplement  Field = "quote.supplement"
+	QuoteNote        Field = "quote.note"
+	QuoteUrl         Field = "quote.url"
+)
+
+// All fields in the order in which they are written to a record.
+var fieldOrder = []Field{
+	FileBatch, FileId, FileDate, FileTitle, QuoteId, CitationBody,
+	QuoteAuthor, QuoteSource, CitationAuthor, CitationEditor, CitationTranslator,
+	CitationYear, CitationYearSuffix, CitationOrigYear, CitationTitle, CitationJournal, CitationContainer,
+	CitationVolume, CitationIssue, CitationStartPage, CitationEndPage,
+	CitationPublisher, CitationPlace, CitationNote,
+	CitationDoi, CitationIsbn, CitationIssn,
+	QuoteKeyword, QuoteBody, QuoteTranslation, QuoteOriginal, QuoteLanguage,
+	QuoteStartPage, QuoteEndPage,
+	QuoteSupplement, QuoteNote, QuoteUrl,
+}
+
+// A `Profile` maps fields to RIS tags. Fields mapped to the empty string, or
+// not mapped at all, are not written. The reference type is always written
+// as `TY`. A field may be mapped to a comma-separated sequence of tags, e.g.,
+// "C1,C2,C3", in which case its values are written to the tags in order.
+type Profile map[Field]string
+
+// The profile used when `OutOpts.Profile` is nil.
+const DefaultProfile = "endnote"
+
+// In the "endnote" profile the citation's title, journal, container, and
+// volume are written to tags which the layout leaves free; a tag which holds
+// a value of the quote is never shared with the citation. The citation's
+// pages, publisher, and place are not written: `SP` and `EP` hold the pages
+// of the quote, `PB` its supplements, and `CY` its first note.
+var profiles = map[string]Profile{
+	"endnote": {
+		FileBatch:          "VL",
+		FileId:             "UR",
+		FileDate:           "AD",
+		QuoteId:            "ID",
+		CitationBody:       "AB",
+		CitationAuthor:     "A1",
+		CitationEditor:     "ED",
+		CitationTranslator: "A4",
+		CitationYear:       "Y1",
+		CitationYearSuffix: "Y1",
+		CitationOrigYear:   "OP",
+		CitationTitle:      "T3",
+		CitationJournal:    "JO",
+		CitationContainer:  "J2",
+		CitationVolume:     "NV", // `VL` holds the batch ID
+		CitationIssue:      "IS",
+		CitationNote:       "T2",
+		CitationDoi:        "DO",
+		CitationIsbn:       "SN",
+		CitationIssn:       "SN",
+		QuoteAuthor:        "A1",
+		QuoteSource:        "A2",
+		QuoteKeyword:       "KW",
+		QuoteBody:          "T1",
+		QuoteTranslation:   "TT",
+		QuoteOriginal:      "C8",
+		QuoteLanguage:      "LA",
+		QuoteStartPage:     "SP",
+		QuoteEndPage:       "EP",
+		QuoteSupplement:    "PB",
+		QuoteNote:          "CY,C1,C2,C3,C4,C5,C6,C7",
+		QuoteUrl:           "UR",
+	},
+	"standard": {
+		FileDate:           "Y2",
+		FileTitle:          "T3",
+		QuoteId:            "ID",
+		CitationBody:       "N1",
+		CitationAuthor:     "AU",
+		CitationEditor:     "A2",
+		CitationTranslator: "A4",
+		CitationYear:       "PY",
+		CitationYearSuffix: "LB",
+		CitationOrigYear:   "OP",
+		CitationTitle:      "TI",
+		CitationJournal:    "T2",
+		CitationContainer:  "T2",
+		CitationVolume:     "VL",
+		CitationIssue:      "IS",
+		CitationPublisher:  "PB",
+		CitationPlace:      "CY",
+		CitationNote:       "N1",
+		CitationDoi:        "DO",
+		CitationIsbn:       "SN",
+		CitationIssn:       "SN",
+		QuoteAuthor:        "A3",
+		QuoteKeyword:       "KW",
+		QuoteBody:          "AB",
+		QuoteTranslation:   "TT",
+		QuoteOriginal:      "N1",
+		QuoteLanguage:      "LA",
+		QuoteStartPage:     "SP",
+		QuoteEndPage:       "EP",
+		QuoteSupplement:    "N1",
+		QuoteNote:          "N1",
+		QuoteUrl:           "UR",
+	},
+}
+
+// `LookupProfile` returns a copy of the built-in profile named `name`.
+func LookupProfile(name string) (Profile, bool) {
+	p, ok := profiles[name]
+	if !ok {
+		return nil, false
+	}
+	return p.clone(), true
+}
+
+// `ProfileNames` returns the names of the built-in profiles, sorted.
+func ProfileNames() []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (p Profile) clone() Profile {
+	c := Profile{}
+	for f, tag := range p {
+		c[f] = tag
+	}
+	return c
+}
+
+// `tag` returns the tag for `f`, or the empty string if `f` is dropped.
+func (p Profile) tag(f Field) string {
+	return p[f]
+}
+
+// `tags` returns the sequence of tags for `f`, or nil if `f` is dropped.
+func (p Profile) tags(f Field) []string {
+	if p[f] == "" {
+		return nil
+	}
+	return strings.Split(p[f], ",")
+}
+
+var risTag = regexp.MustCompile(`^[A-Z][A-Z0-9]$`)
+var mappingLine = regexp.MustCompile(`^([a-z.]+)\p{Zs}*=\p{Zs}*(.*)$`)
+
+// `ReadProfile` reads a mapping file and applies it to a copy of `base`.
+// Each line of a mapping file assigns a field to a tag, or drops it with
+// "-". A "profile" line selects a built-in profile to start from instead of
+// `base`. Blank lines and lines beginning with "#" are ignored:
+//
+//	profile = standard
+//	quote.note = C1,C2,C3
+//	file.id = -
+func ReadProfile(fpath string, base Profile) (Profile, error) {
+	file, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	p := base.clone()
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := mappingLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("%s:%d: expected 'field = TAG'", fpath, lineNo)
+		}
+		field, tag := m[1], m[2]
+		if field == "profile" {
+			named, ok := LookupProfile(tag)
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unknown profile '%s'", fpath, lineNo, tag)
+			}
+			p = named
+			continue
+		}
+		if !slices.Contains(fieldOrder, Field(field)) {
+			return nil, fmt.Errorf("%s:%d: unknown field '%s'", fpath, lineNo, field)
+		}
+		if tag == "-" {
+			p[Field(field)] = ""
+			continue
+		}
+		var tags []string
+		for _, t := range strings.Split(tag, ",") {
+			t = strings.TrimSpace(t)
+			if !risTag.MatchString(t) || t == "TY" || t == "ER" {
+				return nil, fmt.Errorf("%s:%d: invalid tag '%s' for %s", fpath, lineNo, t, field)
+			}
+			tags = append(tags, t)
+		}
+		p[Field(field)] = strings.Join(tags, ",")
+	}
+	return p, scanner.Err()
+}
@@ -2,11 +2,15 @@
 //
 // Parse quote .txt files into .ris format.
 //
-// Assumptions:
+// Assumptions (the markers shown are those of the `DefaultGrammar`; see
+// grammar.go for configuring them):
 //
-//	 The first line is the title of the source.
-//	   - for use of the user in the quote file
-//	   - not used in creating the .ris file
+//	 The first line is the title of the file.
+//	   - it is kept as the `Title` of the parsed file and may be written to
+//	     each record by mapping the "file.title" field, e.g., to T3 or KW
+//	   - it heads generated quote files
+//	   - with the -notitle flag there is no title line, and the file may begin
+//	     directly with a citation
 //
 //	 The second line is a citation.
 //	   - the citation line should be parsed into citation author, year, raw-citation
@@ -16,6 +20,9 @@
 //	   - the first citation line may optionally begin with "<$>" indicating a new source
 //
 //	 Any line beginning with "<$>" is the citation line for a new source.
+//	   - in strict mode, selected with the -strict flag or a "##! strict" line,
+//	     the second line is not assumed to be a citation: all citations begin
+//	     with "<$>", and lines before the first citation form a preamble
 //
 //	 Lines following a citation are quotes IF they end in a page number.
 //	   - quote lines are parsed into quote body and page number
@@ -36,24 +43,72 @@
 //	A line following a citation that begins with "///" starts a multi-line quote
 //	which ends with a page number.
 //
-//	A line following a quote that ends with "%%" attches a supplementary note.
+//	A line following a quote that begins or ends with "%%" attaches a
+//	supplementary note; `qris migrate` rewrites the old suffix form as the
+//	prefix form.
 //
 //	A line following a quote that ends with "jmr" or "jmr." attaches a quote note.
 //
+//	A quote note, supplement, or citation note may span lines as a block which
+//	begins with a line starting "jmr{", "%%{", or "-nb{" and ends with a line
+//	holding only "}".
+//	  - text following the opening marker is the first line of the block
+//	  - a block may also close at the end of its opening line, e.g.,
+//	    "jmr{A short note}"
+//	  - a citation line ends a block which was left open
+//	  - the lines of a block are joined by spaces in RIS output
+//
 //	A line following a quote that begins with "^S:" or "^s:" attaches a keyword
 //	or a keyword list.
+//	  - keywords in a list are separated by ";", e.g., "^S: self; memory"
+//	  - keywords of several keyword lines accumulate
+//	  - a hierarchical keyword separates its levels with ">", e.g.,
+//	    "^S: Psychology > Self"
 //
 //	A line following a quote that begins with "https://" or "http://" attaches a URL.
 //
+//	A line following a citation or quote that begins with "^TY:" overrides the
+//	RIS reference type of the source, e.g., "^TY: CHAP".
+//	  - otherwise the type is inferred from the citation: journal volume and
+//	    issue, "In", "ed.", "dissertation", URLs, and publisher information
+//	    are recognized
+//
+//	A line following a citation or quote of the form "date: YYYY-MM-DD" gives
+//	the date on which quotes from the source were collected.
+//	  - "YYYY-MM" and "YYYY" are also accepted
+//	  - the date is used as the datestamp when the date source is "marker"
+//
 //	A line following a quote that begins with ">>>" specifies a quote author.
 //	  - if a quote author is specified, this name is attached as the primary author
 //	    of the quote and the citation author is attached as the secondary author
 //
+//	A line following a quote that begins with "^TR:" attaches a translation of
+//	the quote; a line beginning with "^OR:" attaches the quote in its original
+//	language, when the quote is itself a translation.
+//	  - either may span lines as a block beginning "^TR:{" or "^OR:{"
+//
+//	A line following a citation or quote that begins with "^LA:" gives the
+//	language of the quote, e.g., "^LA: grc".
+//
+//	Quote author, keyword, URL, and language lines which follow a citation,
+//	before its first quote, apply to every quote of the source.
+//	  - the author, URL, or language of a quote replaces that of the source
+//	  - the keywords of a quote are written in addition to those of the source
+//
+//	 Lines beginning with "##!" are directives which set options for the file,
+//	 e.g., "##! enc = utf8" or "##! keyword = Stoics"; see directive.go.
+//
 //	 Blank lines are ignored
 //
 //	 Other lines are written to a review file in the format:
 //	   - >[line #]
 //	     [discarded line]
+//	       [severity] [code], col [first]-[last]: [explanation]
+//	   - lines which were kept but have problems, e.g., unknown page numbers,
+//	     are reported in the same way; see diagnostic.go
+//	   - lines whose markers are nearly right, e.g., "jrm" or "<S>", are
+//	     reported with a proposed fix, which the -fix flag writes to .txt
+//	     files; see fix.go
 //
 // TODO:
 //
@@ -76,42 +131,10 @@
 //   - I think that many of the calls to `ReplaceAllString` could be replaced
 //     by `ReplaceAllLiteralString`.
 //
-//   - Can I modify so that _all_ citations must begin with "<$>"?
-//
-//   - not now: maybe in the future
-//
-//   - thus, the first line after the title line would no longer be
-//     automatically considered a citation
-//
-//   - this would allow the user to include any number of descriptive lines
-//     before source information in the input file
-//
-//   - this preliminary descriptive information could be collected
-//     in the DISCARDS file
-//
 //   - Should DISCARDS output be optional?
 //
-//   - It makes more sense to me that %% should _precede_ a supplementary note
-//
-//   - then all markup comes at the beginning of a line
-//
-//   - except quote notes which end in jmr
-//
-//   - and quotes which end in page numbers
-//
-//   - The input file title field `tit` is not being used.
-//
-//   - Can I remove this?
-//
-//   - The title line could be sent to the _DISCARDS.ris file.
-//
 //   - Should I move `Line` from `fetch.go` back into this file?
 //
-// _ - Add functionality to store up to N notes following a quote.
-//   - Store notes in a slice or dictionary
-//   - Map notes array to numbered tags, e.g., C1, C2, ....
-//   - Need to discuss this with Jack
-//
 // _ - GetConfigPath should perhaps create a config file if none exists.
 //   - This file would contain the default path to a working directory.
 //
@@ -128,6 +151,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 	"unicode/utf16"
@@ -143,10 +167,64 @@ const (
 	Utf16
 )
 
+var encodingNames = map[string]Encoding{
+	"ascii": Ascii,
+	"ansi":  Ansi,
+	"utf8":  Utf8,
+	"utf16": Utf16,
+}
+
+// `LookupEncoding` returns the `Encoding` named `name`: "ascii", "ansi",
+// "utf8", or "utf16".
+func LookupEncoding(name string) (Encoding, bool) {
+	enc, ok := encodingNames[name]
+	return enc, ok
+}
+
+// `Formats` names the registered exporters used by `WriteResults`; the
+// `DefaultFormat` is used if none are named. An `Encoding` of `None` selects
+// the default encoding of each exporter.
+// `DefaultType` is written as the reference type of citations for which no
+// type was inferred; the package `DefaultType` is used if it is empty.
+// `Profile` maps fields to RIS tags; the `DefaultProfile` is used if it is
+// nil. `Mapping` is the path of the mapping file already applied over
+// `Profile`, if any; it is applied again over a profile selected by a
+// "profile" directive.
+// `DateSource` selects the datestamp written when `DateStamp` is true, and
+// `DateLayout` its layout; `DefaultDateLayout` is used if it is empty.
+// `FixedDate` is the datestamp of `DateFixed`. `Clock` replaces `time.Now`
+// when it is set, e.g., so that tests produce identical output.
+// `Batch` replaces the name of the output directory as the batch ID written
+// when `Volume` is true.
+// `KeywordAncestors` writes each ancestor of a hierarchical keyword as a
+// keyword of its own.
 type OutOpts struct {
-	Volume    bool
-	DateStamp bool
-	Encoding  Encoding
+	Volume      bool
+	DateStamp   bool
+	Encoding    Encoding
+	Formats     []string
+	DefaultType string
+	Profile     Profile
+	Mapping     string
+	DateSource  DateSource
+	DateLayout  string
+	FixedDate   time.Time
+	Clock       func() time.Time
+	Batch       string
+
+	KeywordAncestors bool
+}
+
+// `Grammar` holds the markers of the quote file markup; the zero `Grammar`
+// is the `DefaultGrammar`.
+// In `Strict` mode every citation must begin with the citation marker, and
+// lines before the first citation are kept as the preamble of the file. A
+// file may select strict mode for itself with a "##! strict" line.
+// With `NoTitle` the first line of a file is not taken as its title.
+type InOpts struct {
+	Grammar Grammar
+	Strict  bool
+	NoTitle bool
 }
 
 // The first line of the file is assumed to be the source title.
@@ -155,30 +233,68 @@ type OutOpts struct {
 
 // Parsed from the second line of the file into name, year, body. The note
 // field me be supplied when subsequent file lines are parsed.
+// `Type` is a RIS reference type inferred from the citation body or given
+// on a `^TY:` line; it is empty if neither was available.
+// The remaining fields are parsed from the body when they can be recognized.
+// `Name` holds the raw author segment, which `Authors` or `Editors` split
+// into individual names.
 type Citation struct {
-	Name string
-	Year string
-	Body string
-	Note string
+	Name       string
+	Year       string // four digit year, "n.d.", "forthcoming", or "in press"
+	YearSuffix string // e.g., "e" of "1999e"
+	OrigYear   string // year of original publication of a reprint
+	Body       string
+	Note       string
+	Type       string
+	Date       string // date given on a `date:` line
+
+	Authors     []string
+	Editors     []string
+	Translators []string
+
+	Title     string
+	Container string // journal or book containing the titled work
+	Volume    string
+	Issue     string
+	StartPage string
+	EndPage   string
+	Publisher string
+	Place     string
+
+	DOI  string
+	ISBN string
+	ISSN string
 }
 
 // Parsed from a `Line` for which `IsQuote` is true, or from the `Line`s of a
 // multi-line quote. Includes line number from original file.
 // Body and page are parsed from the lines of a quote. Other fields are supplied
-// as lines are processed.
+// as lines are processed. `Notes` holds the quote notes in the order in which
+// they follow the quote. `Translation` holds a translation of the quote, and
+// `Original` the quote in its original language when the quote is itself a
+// translation; `Lang` is the language of the quote.
 type Quote struct {
-	Auth    string
-	Keyword string
-	Body    []string
-	Page    string
-	Supp    []string
-	Note    string
-	Url     string
+	Auth        string
+	Keywords    []string
+	Body        []string
+	Page        string
+	Supp        []string
+	Notes       []string
+	Url         string
+	Translation string
+	Original    string
+	Lang        string
 }
 
 // A file may include multiple sources.
+// `Auth`, `Keywords`, `Url`, and `Lang` are given by lines following the
+// citation and apply to every quote of the source; see `quoteValues`.
 type Source struct {
 	Citation Citation
+	Auth     string
+	Keywords []string
+	Url      string
+	Lang     string
 	Quotes   []Quote
 }
 
@@ -187,11 +303,27 @@ type Source struct {
 // processing. The `State` is set to `Finished` after processing is completed.
 // `Discards` is a slice of `Line`s which were not recognized. These can be
 // reviewed manually by the user.
+// `Diagnostics` explain each discarded line, and report recognized lines
+// with problems, e.g., malformed pages; see diagnostic.go.
+// `Grammar` holds the markers with which the file was parsed.
+// `Preamble` holds the lines preceding the first citation in strict mode.
 type ParsedFile struct {
-	Filepath string // full filepath
-	State    ParseState
-	Sources  []Source
-	Discards []Line
+	Filepath    string // full filepath
+	Title       string // first line of the file, unless `InOpts.NoTitle`
+	Grammar     Grammar
+	State       ParseState
+	Preamble    []Line
+	Sources     []Source
+	Discards    []Line
+	Diagnostics []Diagnostic
+
+	// Output directives of the file, applied over `OutOpts`; see
+	// `fileOutOpts`.
+	Directives []Directive
+
+	keywords    []string // keywords of "keyword" directives
+	prefixSupps []int    // numbers of lines with prefix supplement markers
+	suffixSupps []int    // numbers of lines with suffix supplement markers
 }
 
 // `getLines` takes a file specified by `fpath` and returns a slice
@@ -213,7 +345,21 @@ func getLines(fpath string) []Line {
 	return rawLines
 }
 
-func WriteDiscards(ds []Line, fname string) {
+// `discardDiagnostics` returns the diagnostics of `ds` which accompany
+// discarded lines.
+func discardDiagnostics(ds []Diagnostic) []Diagnostic {
+	var discards []Diagnostic
+	for _, d := range ds {
+		if strings.HasPrefix(d.Code, "D") {
+			discards = append(discards, d)
+		}
+	}
+	return discards
+}
+
+// `WriteDiscards` writes each diagnostic of `ds` to `fname` following the
+// line to which it applies.
+func WriteDiscards(ds []Diagnostic, fname string) {
 	file, err := os.Create(fname)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -222,8 +368,9 @@ func WriteDiscards(ds []Line, fname string) {
 	defer file.Close()
 
 	for _, d := range ds {
-		fmt.Fprintln(file, "<", d.LineNo, ">")
-		fmt.Fprintln(file, d.Body)
+		fmt.Fprintln(file, "<", d.Line.LineNo, ">")
+		fmt.Fprintln(file, d.Line.Body)
+		fmt.Fprintf(file, "  %s %s, col %d-%d: %s\n", d.Severity, d.Code, d.Col, d.EndCol, d.Msg)
 	}
 }
 
@@ -232,12 +379,11 @@ func writeFieldToFile(f *os.File, field string, data string, enc Encoding) {
 	writeToFile(f, line, enc)
 }
 
-func writeToFile(f *os.File, data string, enc Encoding) {
+func writeToFile(f *os.File, data string, enc Encoding) error {
 	var mapping map[rune]string
 	switch enc {
 	case Utf16:
-		writeToFileUtf16(f, data)
-		return // write utf16 and early return
+		return writeToFileUtf16(f, data) // write utf16 and early return
 	case Utf8:
 		mapping = nil
 	case Ascii:
@@ -247,103 +393,259 @@ func writeToFile(f *os.File, data string, enc Encoding) {
 	default:
 		mapping = utf8ToAnsi()
 	}
-	fmt.Fprint(f, utf8ToNormalized(data, mapping))
+	_, err := fmt.Fprint(f, utf8ToNormalized(data, mapping))
+	return err
 }
 
-func writeToFileUtf16(f *os.File, data string) {
+func writeToFileUtf16(f *os.File, data string) error {
 	runes := []rune(data)
 	codePoints := utf16.Encode(runes) // convert runes to utf-16
-	binary.Write(f, binary.NativeEndian, codePoints)
+	return binary.Write(f, binary.NativeEndian, codePoints)
 }
 
 func WriteQuotes(pf ParsedFile, fname string, outOpts OutOpts) {
-	file, err := os.Create(fname)
-	if err != nil {
+	if err := writeRis(pf, fname, outOpts); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+}
+
+// `risProfile` returns the tag mapping selected by `outOpts`.
+func risProfile(outOpts OutOpts) Profile {
+	if outOpts.Profile != nil {
+		return outOpts.Profile
+	}
+	p, _ := LookupProfile(DefaultProfile)
+	return p
+}
+
+// `citationType` returns the reference type written for `c`.
+func citationType(c Citation, outOpts OutOpts) string {
+	switch {
+	case c.Type != "":
+		return c.Type
+	case outOpts.DefaultType != "":
+		return outOpts.DefaultType
+	default:
+		return DefaultType
+	}
+}
+
+// `quoteValues` returns the values of each field for quote `q` of source `s`,
+// before they are mapped to tags. `file` holds the values of the file fields.
+func quoteValues(s Source, q Quote, file map[Field]string) map[Field][]string {
+	c := s.Citation
+	vs := map[Field][]string{}
+	add := func(f Field, values ...string) {
+		for _, v := range values {
+			if v != "" {
+				// The lines of a block are joined, as RIS values are one line.
+				vs[f] = append(vs[f], strings.ReplaceAll(v, "\n", " "))
+			}
+		}
+	}
+	for f, v := range file {
+		add(f, v)
+	}
+	add(CitationBody, c.Body)
+
+	// Editors stand in for authors when there are no authors, e.g., for
+	// an edited book. The raw name is used if no names were recognized.
+	authors, editors := c.Authors, c.Editors
+	if len(authors) == 0 {
+		authors, editors = editors, nil
+	}
+	if len(authors) == 0 {
+		authors = []string{c.Name}
+	}
+	for _, name := range authors {
+		add(CitationAuthor, risName(name))
+	}
+	for _, name := range editors {
+		add(CitationEditor, risName(name))
+	}
+	for _, name := range c.Translators {
+		add(CitationTranslator, risName(name))
+	}
+	add(CitationYear, c.Year)
+	add(CitationYearSuffix, c.YearSuffix)
+	add(CitationOrigYear, c.OrigYear)
+	add(CitationTitle, c.Title)
+	if c.Type == "JOUR" {
+		add(CitationJournal, c.Container)
+	} else {
+		add(CitationContainer, c.Container)
+	}
+	add(CitationVolume, c.Volume)
+	add(CitationIssue, c.Issue)
+	add(CitationStartPage, c.StartPage)
+	add(CitationEndPage, c.EndPage)
+	add(CitationPublisher, c.Publisher)
+	add(CitationPlace, c.Place)
+	add(CitationNote, c.Note)
+	add(CitationDoi, c.DOI)
+	add(CitationIsbn, c.ISBN)
+	add(CitationIssn, c.ISSN)
+
+	add(QuoteId, quoteId(c, q))
+
+	// Quotes inherit the author, keywords, URL, and language of their
+	// source: the author, URL, and language of a quote replace those of the
+	// source, and the keywords of a quote are added to those of the source.
+	auth, url, lang := q.Auth, q.Url, q.Lang
+	if auth == "" {
+		auth = s.Auth
+	}
+	if url == "" {
+		url = s.Url
+	}
+	if lang == "" {
+		lang = s.Lang
+	}
+	if auth != "" {
+		add(QuoteAuthor, auth)
+		add(QuoteSource, "in "+familyNames(authors))
+	}
+	add(QuoteKeyword, mergeKeywords(s.Keywords, q.Keywords)...)
+	vs[QuoteBody] = q.Body // blank lines of a quote are kept
+	add(QuoteTranslation, q.Translation)
+	add(QuoteOriginal, q.Original)
+	add(QuoteLanguage, lang)
+	if loc, err := parseLocator(q.Page); err == nil {
+		sp, ep := loc.Pages()
+		add(QuoteStartPage, sp)
+		add(QuoteEndPage, ep)
+	} else if err != errPageUnknown {
+		add(QuoteStartPage, q.Page) // keep malformed pages as written
+	}
+	add(QuoteSupplement, q.Supp...)
+	add(QuoteNote, q.Notes...)
+	add(QuoteUrl, url)
+	return vs
+}
+
+// `quoteFields` maps the values of `quoteValues` to tags using profile `p`.
+// A quote author replaces the citation authors when both map to the same
+// tag, and a year suffix mapped to the tag of the year is appended to the
+// year, e.g., "1999e".
+// Fields mapped to a sequence of tags which has fewer tags than values are
+// returned in `overflow`; their extra values are not written.
+func quoteFields(vs map[Field][]string, p Profile) (fs []RisField, overflow []Field) {
+	skip := map[Field]bool{}
+	if vs[QuoteAuthor] != nil && p.tag(QuoteAuthor) == p.tag(CitationAuthor) {
+		skip[CitationAuthor] = true
+	}
+	if vs[CitationYear] != nil && vs[CitationYearSuffix] != nil &&
+		p.tag(CitationYearSuffix) == p.tag(CitationYear) {
+		vs[CitationYear] = []string{vs[CitationYear][0] + vs[CitationYearSuffix][0]}
+		skip[CitationYearSuffix] = true
+	}
+	for _, f := range fieldOrder {
+		tags := p.tags(f)
+		if len(tags) == 0 || skip[f] {
+			continue
+		}
+		for i, v := range vs[f] {
+			switch {
+			case len(tags) == 1:
+				fs = append(fs, RisField{Tag: tags[0], Value: v})
+			case i < len(tags):
+				fs = append(fs, RisField{Tag: tags[i], Value: v})
+			case i == len(tags):
+				overflow = append(overflow, f)
+			}
+		}
+	}
+	return fs, overflow
+}
+
+func writeRis(pf ParsedFile, fname string, outOpts OutOpts) error {
+	file, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
 	// Use encoding:
 	enc := outOpts.Encoding
-
-	// batch ID
-	bid := filepath.Base(filepath.Dir(fname))
+	profile := risProfile(outOpts)
 
 	// file ID
 	fid := filepath.Base(pf.Filepath)
 	fid = strings.TrimSuffix(fid, filepath.Ext(fid))
+	fileValues := map[Field]string{FileId: fid, FileTitle: pf.Title}
 
-	// timestamp: when file was processed
-	dStamp := time.Now().Format("2006/01/02")
+	// batch ID
+	if outOpts.Volume {
+		fileValues[FileBatch] = outOpts.Batch
+		if outOpts.Batch == "" {
+			fileValues[FileBatch] = filepath.Base(filepath.Dir(fname))
+		}
+	}
+
+	// datestamp: see `DateSource`
+	stamp := datestamper(pf, outOpts)
 
 	// Start file with a blank line per RIS specification.
 	writeToFile(file, LineEnding, enc)
 
 	for _, s := range pf.Sources { // loop over sources of the parsed file
-		citBody := s.Citation.Body
-		citName := s.Citation.Name
-		citYear := s.Citation.Year
-		citNote := s.Citation.Note
-
+		citType := citationType(s.Citation, outOpts)
+		if outOpts.DateStamp {
+			fileValues[FileDate] = stamp(s.Citation)
+		}
+		if outOpts.KeywordAncestors {
+			s.Keywords = keywordAncestors(s.Keywords)
+		}
 		for _, q := range s.Quotes { // loop over quotes of each source
-			writeFieldToFile(file, "TY", "", enc)
-			if outOpts.Volume {
-				writeFieldToFile(file, "VL", bid, enc)
-			}
-			writeFieldToFile(file, "UR", fid, enc)
-			if outOpts.DateStamp {
-				writeFieldToFile(file, "AD", dStamp, enc)
+			if outOpts.KeywordAncestors {
+				q.Keywords = keywordAncestors(q.Keywords)
 			}
-			writeFieldToFile(file, "AB", citBody, enc)
-
-			// A1 gets citation name unless a primary quote author was specified
-			if q.Auth != "" {
-				writeFieldToFile(file, "A1", q.Auth, enc)
-				familyName := citationFamilyName.FindString(citName)
-				familyName = strings.TrimSpace(familyName)
-				writeFieldToFile(file, "A2", "in "+familyName, enc)
-			} else {
-				writeFieldToFile(file, "A1", citName, enc)
+			writeFieldToFile(file, "TY", citType, enc)
+			fs, _ := quoteFields(quoteValues(s, q, fileValues), profile)
+			for _, f := range fs {
+				writeFieldToFile(file, f.Tag, f.Value, enc)
 			}
+			writeFieldToFile(file, "ER", "", enc)
+			writeToFile(file, LineEnding, enc)
+		}
+	}
+	return nil
+}
 
-			if citYear != "" {
-				writeFieldToFile(file, "Y1", citYear, enc)
-			}
-			if citNote != "" {
-				writeFieldToFile(file, "T2", citNote, enc)
-			}
-			if q.Keyword != "" {
-				writeFieldToFile(file, "KW", q.Keyword, enc)
-			}
-			if q.Body != nil {
-				for _, line := range q.Body {
-					writeFieldToFile(file, "T1", line, enc)
-				}
-			}
-			if q.Page != "" {
-				writeFieldToFile(file, "SP", q.Page, enc)
-			}
-			if q.Supp != nil {
-				for _, supp := range q.Supp {
-					writeFieldToFile(file, "PB", supp, enc)
-				}
-			}
-			if q.Note != "" {
-				writeFieldToFile(file, "CY", q.Note, enc)
+// `OutputDiagnostics` returns a warning for each directive of `pf` which
+// cannot be applied over `outOpts`, and for each quote of `pf` with more
+// values of a field than the RIS profile of `outOpts` has tags for; the extra
+// values are not written. There are no warnings of the second kind unless
+// RIS is an output format.
+func OutputDiagnostics(pf ParsedFile, outOpts OutOpts) []Diagnostic {
+	outOpts, ds := pf.fileOutOpts(outOpts)
+	if len(outOpts.Formats) > 0 && !slices.Contains(outOpts.Formats, "ris") {
+		return ds
+	}
+	profile := risProfile(outOpts)
+	for _, s := range pf.Sources {
+		if outOpts.KeywordAncestors {
+			s.Keywords = keywordAncestors(s.Keywords)
+		}
+		for _, q := range s.Quotes {
+			if outOpts.KeywordAncestors {
+				q.Keywords = keywordAncestors(q.Keywords)
 			}
-			if q.Url != "" {
-				writeFieldToFile(file, "UR", q.Url, enc)
+			_, overflow := quoteFields(quoteValues(s, q, nil), profile)
+			for _, f := range overflow {
+				ds = append(ds, Diagnostic{Code: CodeTagOverflow, Severity: SevWarning,
+					Msg: fmt.Sprintf("quote on page %s has more %s values than tags (%s); extra values dropped",
+						q.Page, f, profile[f])})
 			}
-			writeFieldToFile(file, "ER", "", enc)
-			writeToFile(file, LineEnding, enc)
 		}
 	}
+	return ds
 }
 
 // `ProcessQuoteFiles` iterates over a list of files and returns
-// a list of `ParsedFile`s.
-func ProcessQuoteFiles(workPath string, dataList []string) []ParsedFile {
+// a list of `ParsedFile`s. Quote files are parsed using `inOpts`.
+func ProcessQuoteFiles(workPath string, dataList []string, inOpts InOpts) []ParsedFile {
 	var parsedFiles []ParsedFile
 	processedCount := 0
 	for _, f := range dataList {
@@ -353,7 +655,25 @@ func ProcessQuoteFiles(workPath string, dataList []string) []ParsedFile {
 		}
 		fmt.Printf("Processing %s...\n", f) // Display file name as it is processed
 		pFile := filepath.Join(workPath, f) // File path to process
-		parsedFiles = append(parsedFiles, ProcessFile(pFile))
+		var pf ParsedFile
+		if isJsonFile(f) {
+			var err error
+			if pf, err = processJsonFile(pFile); err != nil {
+				fmt.Fprintf(os.Stderr, "  %s: %v; skipped\n", f, err)
+				continue
+			}
+		} else {
+			pf = ProcessFile(pFile, inOpts)
+		}
+		if n := len(pf.Preamble); n > 0 {
+			fmt.Printf("  preamble: %d lines before the first citation\n", n)
+		}
+		for _, d := range pf.Diagnostics {
+			if d.Severity > SevInfo {
+				fmt.Fprintf(os.Stderr, "  %s\n", d)
+			}
+		}
+		parsedFiles = append(parsedFiles, pf)
 		processedCount += 1
 	}
 	switch processedCount {
@@ -367,20 +687,42 @@ func ProcessQuoteFiles(workPath string, dataList []string) []ParsedFile {
 	return parsedFiles
 }
 
-// `WriteResults` iterates over a list of files, ensures that none are
-// directories, parses each file,  and writes the results to output files.
+// `processJsonFile` reads `Source`s previously exported as JSON. There is no
+// markup to parse, so the result has no discards.
+func processJsonFile(fpath string) (ParsedFile, error) {
+	srcs, err := JsonToSources(fpath)
+	if err != nil {
+		return ParsedFile{}, err
+	}
+	return ParsedFile{
+		Filepath: fpath,
+		State:    Finished,
+		Sources:  srcs,
+	}, nil
+}
+
+// `WriteResults` iterates over a list of parsed files and writes the results
+// to output files, one for each of the formats in `outOpts`.
 func WriteResults(parsedFiles []ParsedFile, outOpts OutOpts) {
+	formats := outOpts.Formats
+	if len(formats) == 0 {
+		formats = []string{DefaultFormat}
+	}
 	for _, pf := range parsedFiles {
 		fpath := pf.Filepath
 		base := strings.TrimSuffix(fpath, filepath.Ext(fpath))
-		pQuotes := base + parsedSuffix // File to store parsed quotes
 
-		WriteQuotes(pf, pQuotes, outOpts)
+		for _, format := range formats {
+			if err := exportFile(pf, format, outOpts); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
 
 		// Only write a _DISCARD file if there were discarded lines.
 		if len(pf.Discards) > 0 {
 			pDiscard := base + discardSuffix // File to store discarded lines
-			WriteDiscards(pf.Discards, pDiscard)
+			WriteDiscards(discardDiagnostics(pf.Diagnostics), pDiscard)
 		}
 	}
 }
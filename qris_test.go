@@ -3,11 +3,15 @@
 package qris
 
 import (
+	"archive/zip"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestDetermineLineType(t *testing.T) {
@@ -37,9 +41,34 @@ func TestDetermineLineType(t *testing.T) {
 			ps:       Start,
 			wantType: CitationLn,
 		},
+		{
+			input:    `date: 2021-03-04`,
+			ps:       InQuote,
+			wantType: DateLn,
+		},
+		{
+			input:    `Date: the day was cold.`,
+			ps:       InQuote,
+			wantType: UnknownLn,
+		},
+		{
+			input:    `^s: mind`,
+			ps:       InQuote,
+			wantType: KeywordLn,
+		},
+		{
+			input:    `Nothing like it. JMR`,
+			ps:       InQuote,
+			wantType: UnknownLn,
+		},
+		{
+			input:    `^ty: BOOK`,
+			ps:       InQuote,
+			wantType: UnknownLn,
+		},
 	}
 	for n, tc := range testCases {
-		lt := determineLineType(tc.input, tc.ps)
+		lt := determineLineType(tc.input, tc.ps, defaultGrammar)
 		if lt != tc.wantType {
 			t.Errorf("failure in [%d]\n"+
 				"found: %v\n"+
@@ -60,7 +89,7 @@ func TestGetSource(t *testing.T) {
 			input: `Brown, Jason W. "Neuropsychology and the self-concept." ` +
 				`The Journal of Nervous and Mental Disease. 187 no.3 (1999e): 131-41.`,
 			wantName: "Brown, Jason W.",
-			wantYear: "1999e",
+			wantYear: "1999",
 			wantBody: `Brown, Jason W. "Neuropsychology and the self-concept." ` +
 				`The Journal of Nervous and Mental Disease. 187 no.3 (1999e): 131-41.`,
 		},
@@ -84,7 +113,7 @@ func TestGetSource(t *testing.T) {
 		{
 			input:    `Gurwitsch, Aron. {Field of Consciousness}. Pittsburgh: Duquesne University Press, 1964 (1957).`,
 			wantName: `Gurwitsch, Aron`,
-			wantYear: `1957`,
+			wantYear: `1964`,
 			wantBody: `Gurwitsch, Aron. {Field of Consciousness}. Pittsburgh: Duquesne University Press, 1964 (1957).`,
 		},
 	}
@@ -111,6 +140,37 @@ func TestGetSource(t *testing.T) {
 	}
 }
 
+func TestParseYear(t *testing.T) {
+	testCases := []struct {
+		input      string
+		wantYear   string
+		wantSuffix string
+		wantOrig   string
+	}{
+		{input: "The Journal of Nervous and Mental Disease. 187 no.3 (1999e): 131-41.",
+			wantYear: "1999", wantSuffix: "e"},
+		{input: "Pittsburgh: Duquesne University Press, 1964 (1957).",
+			wantYear: "1964", wantOrig: "1957"},
+		{input: "New York: Dover, [1961] 1988b.", wantYear: "1988", wantSuffix: "b", wantOrig: "1961"},
+		{input: "New York: Dover, 1988 [1961].", wantYear: "1988", wantOrig: "1961"},
+		{input: "Paris: Gallimard, 1951/2004.", wantYear: "2004", wantOrig: "1951"},
+		{input: "Smith, J. {Title}. Boston: Beacon, n.d.", wantYear: "n.d."},
+		{input: "Smith, J. {Title}. Boston: Beacon, nd.", wantYear: "n.d."},
+		{input: "Smith, J. “Title.” {Mind} (forthcoming).", wantYear: "forthcoming"},
+		{input: "Smith, J. “Title.” {Mind}, In Press.", wantYear: "in press"},
+		{input: "Smith, J. {Title}. Boston: Beacon."},
+	}
+	for n, tc := range testCases {
+		year, suffix, orig := parseYear(tc.input)
+		if year != tc.wantYear || suffix != tc.wantSuffix || orig != tc.wantOrig {
+			t.Errorf("failure in [%d]\n"+
+				"year, suffix, orig = %q, %q, %q\n"+
+				"want: %q, %q, %q",
+				n, year, suffix, orig, tc.wantYear, tc.wantSuffix, tc.wantOrig)
+		}
+	}
+}
+
 func TestGetNote(t *testing.T) {
 	qNoteLine := `page numbers are accoring to the pdf made by jmr --jmr`
 	note := getNote(qNoteLine)
@@ -193,7 +253,7 @@ func TestGetQuote(t *testing.T) {
 		},
 	}
 	for n, tc := range testCases {
-		b, p := getQuote(tc.input)
+		b, p := getQuote(tc.input, defaultGrammar)
 		if b != tc.wantBody {
 			t.Errorf("failure in Body of <exTestLines[%d]>\n"+
 				"Body = %s\n\n"+
@@ -235,7 +295,7 @@ func TestWriteResults(t *testing.T) {
 	for _, tf := range testFiles {
 		dataList, workPath := GetWorkPath(workDir, batchPath, tf)
 		// Process a test file.
-		parsedFiles := ProcessQuoteFiles(workPath, dataList)
+		parsedFiles := ProcessQuoteFiles(workPath, dataList, InOpts{})
 		// Write results to test directory.
 		WriteResults(parsedFiles, OutOpts{Volume: volume, DateStamp: dateStamp, Encoding: enc})
 
@@ -262,3 +322,1348 @@ func TestWriteResults(t *testing.T) {
 		_ = os.Remove(discardPath)
 	}
 }
+
+func TestExporters(t *testing.T) {
+	formatCases := []struct {
+		list string
+		want []string
+	}{
+		{"ris", []string{"ris"}},
+		{"ris, json", []string{"ris", "json"}},
+		{"docx,ris,docx", []string{"docx", "ris"}},
+		{"xml", nil},
+		{"ris,", nil},
+	}
+	for n, c := range formatCases {
+		got, err := ParseFormats(c.list)
+		if !slices.Equal(got, c.want) || (err != nil) != (c.want == nil) {
+			t.Errorf("failure in ParseFormats [%d]: %v, %v", n, got, err)
+		}
+	}
+
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "quotes.txt")
+	if err := os.WriteFile(fpath, []byte("Title\n<$> Café, J. 1999. A Title.\nA quote.\tp. 12\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pf := ProcessFile(fpath, InOpts{})
+	testCases := []struct {
+		format string
+		enc    Encoding
+		suffix string
+		want   string // text of the output in its encoding
+	}{
+		{"ris", None, parsedSuffix, "Caf\xe9"},
+		{"ris", Utf8, parsedSuffix, "Café"},
+		{"txt", None, canonTxtSuffix, "Café"},
+		{"txt", Ansi, canonTxtSuffix, "Caf\xe9"},
+		{"json", None, jsonSuffix, "Café"},
+		{"diagnostics", None, diagnosticsSuffix, "[]"},
+		{"docx", None, canonSuffix, "PK"},
+	}
+	for n, c := range testCases {
+		if err := exportFile(pf, c.format, OutOpts{Encoding: c.enc}); err != nil {
+			t.Fatalf("failure in [%d]: %v", n, err)
+		}
+		fname := filepath.Join(dir, "quotes"+c.suffix)
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			t.Fatalf("failure in [%d]: %v", n, err)
+		}
+		if !strings.Contains(string(data), c.want) {
+			t.Errorf("failure in [%d]: %s does not contain %q", n, fname, c.want)
+		}
+		os.Remove(fname)
+	}
+	if err := exportFile(pf, "xml", OutOpts{}); err == nil {
+		t.Errorf("unknown format exported")
+	}
+
+	WriteResults([]ParsedFile{pf}, OutOpts{Formats: []string{"ris", "json"}})
+	for _, suffix := range []string{parsedSuffix, jsonSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, "quotes"+suffix)); err != nil {
+			t.Errorf("WriteResults: %v", err)
+		}
+	}
+}
+
+// Parsing a generated canonical quote file should recover the sources
+// it was generated from.
+func TestWriteQuoteFile(t *testing.T) {
+	testFiles := []string{
+		"test_descriptive_citations.docx",
+		"test_example_citations.docx",
+		"bib22e_FUNKY.docx",
+		"24Brown1997_Qu.docx",
+	}
+	tmpDir := t.TempDir()
+	for _, tf := range testFiles {
+		pf := ProcessFile(filepath.Join("test_files", tf), InOpts{})
+		for _, ext := range []string{".docx", ".txt"} {
+			canon := filepath.Join(tmpDir, strings.TrimSuffix(tf, ".docx")+ext)
+			if err := WriteQuoteFile("Title", pf.Sources, canon); err != nil {
+				t.Fatalf("%v: unable to write %s", err, canon)
+			}
+			got := ProcessFile(canon, InOpts{})
+			if !reflect.DeepEqual(got.Sources, pf.Sources) {
+				t.Errorf("%s: sources do not survive a round trip", canon)
+			}
+			if len(got.Discards) != 0 {
+				t.Errorf("%s: canonical file has %d discards", canon, len(got.Discards))
+			}
+		}
+	}
+}
+
+// Only .json files ending in `sourcesSuffix` are read as input, and a
+// malformed one is skipped without ending the batch.
+func TestJsonInput(t *testing.T) {
+	testCases := []struct {
+		fname   string
+		isInput bool
+	}{
+		{"quotes.txt", true},
+		{"quotes.docx", true},
+		{"quotes_SOURCES.json", true},
+		{"quotes.json", false},
+		{"quotes_PARSED.json", false},
+		{"quotes_DIAGNOSTICS.json", false},
+		{"quotes_DISCARD.txt", false},
+		{"quotes_MIGRATED.docx", false},
+	}
+	for n, c := range testCases {
+		if got := !notInputFile(c.fname); got != c.isInput {
+			t.Errorf("failure in [%d]: %s is input = %v", n, c.fname, got)
+		}
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"bad_SOURCES.json":  "[{",
+		"good_SOURCES.json": `[{"Citation": {"Body": "Smith, J. 1999."}}]`,
+	}
+	for f, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pfs := ProcessQuoteFiles(dir, []string{"bad_SOURCES.json", "good_SOURCES.json"}, InOpts{})
+	if len(pfs) != 1 || len(pfs[0].Sources) != 1 {
+		t.Errorf("parsed files = %v", pfs)
+	}
+}
+
+// Reading back the RIS files written for the test files should recover
+// the sources they were written from.
+func TestRisToSources(t *testing.T) {
+	testFiles := []string{
+		"test_descriptive_citations",
+		"test_example_citations",
+		"bib22e_FUNKY",
+		"24Brown1997_Qu",
+	}
+	for _, tf := range testFiles {
+		pf := ProcessFile(filepath.Join("test_files", tf+".docx"), InOpts{})
+		recs, err := ReadRis(filepath.Join("test_files", tf+"_EXPECT.ris"))
+		if err != nil {
+			t.Fatalf("%v: unable to read %s", err, tf)
+		}
+		// Page groups are normalized when they are written.
+		for _, s := range pf.Sources {
+			for i, q := range s.Quotes {
+				if loc, err := parseLocator(q.Page); err == nil {
+					s.Quotes[i].Page = loc.String()
+				}
+			}
+		}
+		if srcs := RisToSources(recs); !reflect.DeepEqual(srcs, pf.Sources) {
+			t.Errorf("%s: sources read from RIS do not match parsed sources", tf)
+		}
+	}
+}
+
+func TestClassifyCitation(t *testing.T) {
+	testCases := []struct {
+		input    string
+		wantType string
+	}{
+		{
+			input: `Brown, Jason W. "Neuropsychology and the self-concept." ` +
+				`The Journal of Nervous and Mental Disease. 187 no.3 (1999e): 131-41.`,
+			wantType: "JOUR",
+		},
+		{
+			input:    `Bermúdez, José Luis. {Thinking without Words}. New York, NY: Oxford University Press, 2003.`,
+			wantType: "BOOK",
+		},
+		{
+			input: `Rotman, Brian. “Forword.” In {Diagrams and Gestures. } ed. F. La Mantia, ` +
+				`C. Alunni and F. Zalamea. Cham: Springer, 2023 (?).`,
+			wantType: "CHAP",
+		},
+		{
+			input:    `Nicholson, D. J. and J. Dupré, eds. {Everything Flows}. Oxford: Oxford University Press, 2018.`,
+			wantType: "EDBOOK",
+		},
+		{
+			input:    `Smith, Jane. {Memory and the Self}. PhD dissertation, University of Chicago, 2015.`,
+			wantType: "THES",
+		},
+		{
+			input:    `Gallagher, Shaun. “Phenomenology.” https://plato.stanford.edu/entries/phenomenology/`,
+			wantType: "ELEC",
+		},
+		{
+			input:    `Anonymous. Notes on a conversation.`,
+			wantType: "",
+		},
+	}
+	for n, tc := range testCases {
+		src := getSource(tc.input)
+		if src.Citation.Type != tc.wantType {
+			t.Errorf("failure in [%d]\n"+
+				"Type = %s\n"+
+				"want: %s",
+				n, src.Citation.Type, tc.wantType)
+		}
+	}
+
+	lookupCases := []struct {
+		name string
+		want string
+	}{
+		{"BOOK", "BOOK"},
+		{" chap ", "CHAP"},
+		{"FOO", ""},
+		{"", ""},
+	}
+	for n, c := range lookupCases {
+		if got, ok := LookupType(c.name); got != c.want || ok != (c.want != "") {
+			t.Errorf("failure in LookupType [%d]: %q, %v", n, got, ok)
+		}
+	}
+}
+
+func TestParseCitation(t *testing.T) {
+	testCases := []struct {
+		input string
+		want  Citation
+	}{
+		{
+			input: `Brown, Jason W. "Neuropsychology and the self-concept." ` +
+				`The Journal of Nervous and Mental Disease. 187 no.3 (1999e): 131-41.`,
+			want: Citation{
+				Title:     "Neuropsychology and the self-concept",
+				Container: "The Journal of Nervous and Mental Disease",
+				Volume:    "187",
+				Issue:     "3",
+				StartPage: "131",
+				EndPage:   "141",
+			},
+		},
+		{
+			input: `Kelso, J. A. Scott. “Metastable Mind.” In {Cognitive Architecture. }ed. ` +
+				`D. Hauptmann and W. Neidich. Rotterdam: 010 Publishers, 2011 (116-138).`,
+			want: Citation{
+				Title:     "Metastable Mind",
+				Container: "Cognitive Architecture",
+				StartPage: "116",
+				EndPage:   "138",
+				Publisher: "010 Publishers",
+				Place:     "Rotterdam",
+			},
+		},
+		{
+			input: `Simon, Bennett {Mind and Madness in Ancient Greece} Ithaca, NY: Cornell University Press, 1978.`,
+			want: Citation{
+				Title:     "Mind and Madness in Ancient Greece",
+				Publisher: "Cornell University Press",
+				Place:     "Ithaca, NY",
+			},
+		},
+	}
+	for n, tc := range testCases {
+		c := Citation{Body: tc.input}
+		parseCitation(&c)
+		tc.want.Body = tc.input
+		if !reflect.DeepEqual(c, tc.want) {
+			t.Errorf("failure in [%d]\n"+
+				"found: %+v\n"+
+				"want: %+v",
+				n, c, tc.want)
+		}
+	}
+}
+
+func TestParseNames(t *testing.T) {
+	testCases := []struct {
+		input           string
+		wantAuthors     []string
+		wantEditors     []string
+		wantTranslators []string
+	}{
+		{
+			input:       `Smith, J., K. Jones, and L. Brown. {A Book}. Boston: Beacon Press, 2001.`,
+			wantAuthors: []string{"Smith, J.", "K. Jones", "L. Brown"},
+		},
+		{
+			input:       `Brown, J. W., ed. {The Self}. New York: Academic Press, 1990.`,
+			wantEditors: []string{"Brown, J. W."},
+		},
+		{
+			input:       `Lastname, Firstname, M.I. et al. “Article Title” Publisher Information, (2000)`,
+			wantAuthors: []string{"Lastname, Firstname, M.I."},
+		},
+		{
+			input:       `World Health Organization. {Mental Health Atlas}. Geneva: WHO, 2018.`,
+			wantAuthors: []string{"World Health Organization"},
+		},
+		{
+			input: `Helmholtz, Hermann von. “On the facts underlying geometry.” In {Epistemological Writings. } ` +
+				`ed. R. S. Cohen and Yehuda Elkana. Dordrecht: D. Reidel Pub. Co., 1977 (1868) (39-71).`,
+			wantAuthors: []string{"Helmholtz, Hermann von"},
+			wantEditors: []string{"R. S. Cohen", "Yehuda Elkana"},
+		},
+		{
+			input: `Cassirer, Ernst. {The Problem of Knowledge; Philosophy, Science, and History Since Hegel, } ` +
+				`with William H. Woglom and Charles William Hendel (trs). New Haven; London: Yale UP, 1950 (1940).`,
+			wantAuthors:     []string{"Cassirer, Ernst"},
+			wantTranslators: []string{"William H. Woglom", "Charles William Hendel"},
+		},
+		{
+			input:           `Homer. {The Iliad}. Trans. Richmond Lattimore. Chicago: University of Chicago Press, 1951.`,
+			wantAuthors:     []string{"Homer"},
+			wantTranslators: []string{"Richmond Lattimore"},
+		},
+	}
+	for n, tc := range testCases {
+		c := getSource(tc.input).Citation
+		if !slices.Equal(c.Authors, tc.wantAuthors) ||
+			!slices.Equal(c.Editors, tc.wantEditors) ||
+			!slices.Equal(c.Translators, tc.wantTranslators) {
+			t.Errorf("failure in [%d]\n"+
+				"found: %q %q %q\n"+
+				"want: %q %q %q",
+				n, c.Authors, c.Editors, c.Translators,
+				tc.wantAuthors, tc.wantEditors, tc.wantTranslators)
+		}
+	}
+}
+
+func TestParseLocator(t *testing.T) {
+	testCases := []struct {
+		input   string
+		wantSP  string
+		wantEP  string
+		wantErr error
+	}{
+		{input: "42", wantSP: "42"},
+		{input: "131-41", wantSP: "131", wantEP: "141"},
+		{input: "240 -- 42", wantSP: "240", wantEP: "242"},
+		{input: "164, 5", wantSP: "164, 165"},
+		{input: "5, 9f", wantSP: "5, 9f"},
+		{input: "5 9", wantSP: "5, 9"},
+		{input: "xii-xiv", wantSP: "xii", wantEP: "xiv"},
+		{input: "22ff", wantSP: "22ff"},
+		{input: "41ff – 42ff", wantSP: "41", wantEP: "42ff"},
+		{input: "?", wantErr: errPageUnknown},
+		{input: "xiix", wantErr: errPageRoman},
+		{input: "xii-14", wantErr: errPageMixed},
+		{input: "45-12", wantErr: errPageOrder},
+		{input: "12 EXTRA", wantErr: errPageMalformed},
+	}
+	for n, tc := range testCases {
+		loc, err := parseLocator(tc.input)
+		if err != tc.wantErr {
+			t.Errorf("failure in [%d]: error = %v, want: %v", n, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if sp, ep := loc.Pages(); sp != tc.wantSP || ep != tc.wantEP {
+			t.Errorf("failure in [%d]\n"+
+				"SP, EP = %s, %s\n"+
+				"want: %s, %s",
+				n, sp, ep, tc.wantSP, tc.wantEP)
+		}
+	}
+}
+
+func TestQuoteFields(t *testing.T) {
+	src := getSource("Smith, J. {A Title}. Boston: Beacon, 1999.")
+	q := Quote{Auth: "Jones", Body: []string{"text"}, Page: "12-4", Notes: []string{"note"}}
+	file := map[Field]string{FileId: "fid", FileBatch: "batch"}
+	standard, _ := LookupProfile("standard")
+	endnote, _ := LookupProfile("endnote")
+	dropped := standard.clone()
+	dropped[QuoteNote] = ""
+	dropped[QuoteId] = ""
+	id := "ID " + quoteId(src.Citation, q)
+	testCases := []struct {
+		profile Profile
+		want    []string
+	}{
+		{profile: endnote, want: []string{
+			"VL batch", "UR fid", id, "AB " + src.Citation.Body, "A1 Jones", "A2 in Smith",
+			"Y1 1999", "T3 A Title", "T1 text", "SP 12", "EP 14", "CY note"}},
+		{profile: standard, want: []string{
+			id, "N1 " + src.Citation.Body, "A3 Jones", "AU Smith, J.", "PY 1999",
+			"TI A Title", "PB Beacon", "CY Boston", "AB text", "SP 12", "EP 14", "N1 note"}},
+		{profile: dropped, want: []string{
+			"N1 " + src.Citation.Body, "A3 Jones", "AU Smith, J.", "PY 1999",
+			"TI A Title", "PB Beacon", "CY Boston", "AB text", "SP 12", "EP 14"}},
+	}
+	for n, tc := range testCases {
+		var got []string
+		fs, _ := quoteFields(quoteValues(src, q, file), tc.profile)
+		for _, f := range fs {
+			got = append(got, f.Tag+" "+f.Value)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("failure in [%d]\ngot:  %q\nwant: %q", n, got, tc.want)
+		}
+	}
+
+	// The batch ID and the volume of a journal article are both written.
+	jour := getSource(`Smith, J. "A Title." The Journal of Tests 187 no.3 (1999): 131-41.`)
+	fs, _ := quoteFields(quoteValues(jour, q, file), endnote)
+	var tags []string
+	for _, f := range fs {
+		tags = append(tags, f.Tag+" "+f.Value)
+	}
+	for _, want := range []string{"VL batch", "NV 187", "IS 3", "JO The Journal of Tests"} {
+		if !slices.Contains(tags, want) {
+			t.Errorf("journal fields %q lack %q", tags, want)
+		}
+	}
+
+	// The year suffix is appended to the year when both map to one tag.
+	suffixed := getSource("Smith, J. {A Title}. Boston: Beacon, 1999e.")
+	suffixCases := []struct {
+		profile Profile
+		want    []string
+	}{
+		{profile: endnote, want: []string{"Y1 1999e"}},
+		{profile: standard, want: []string{"PY 1999", "LB e"}},
+	}
+	for n, tc := range suffixCases {
+		fs, _ := quoteFields(quoteValues(suffixed, q, nil), tc.profile)
+		var got []string
+		for _, f := range fs {
+			if f.Tag == "Y1" || f.Tag == "PY" || f.Tag == "LB" {
+				got = append(got, f.Tag+" "+f.Value)
+			}
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("failure in year suffix [%d]: %q, want %q", n, got, tc.want)
+		}
+	}
+}
+
+func TestQuoteNotes(t *testing.T) {
+	src := getSource("Smith, J. {A Title}. Boston: Beacon, 1999.")
+	q := Quote{Body: []string{"text"}, Page: "12", Notes: []string{"one", "two", "three"}}
+	p := Profile{QuoteNote: "C1,C2"}
+	fs, overflow := quoteFields(quoteValues(src, q, nil), p)
+	want := []RisField{{Tag: "C1", Value: "one"}, {Tag: "C2", Value: "two"}}
+	if !slices.Equal(fs, want) || !slices.Equal(overflow, []Field{QuoteNote}) {
+		t.Errorf("tag sequence: fields = %v, overflow = %v", fs, overflow)
+	}
+	p = Profile{QuoteNote: "N1"}
+	fs, overflow = quoteFields(quoteValues(src, q, nil), p)
+	if len(fs) != 3 || overflow != nil {
+		t.Errorf("single tag: fields = %v, overflow = %v", fs, overflow)
+	}
+
+	pf := ParsedFile{Sources: []Source{{Citation: src.Citation, Quotes: []Quote{q}}}}
+	ds := OutputDiagnostics(pf, OutOpts{Profile: Profile{QuoteNote: "C1,C2"}})
+	if len(ds) != 1 || ds[0].Code != CodeTagOverflow || !strings.Contains(ds[0].String(), "page 12") {
+		t.Errorf("OutputDiagnostics = %v", ds)
+	}
+	if ds := OutputDiagnostics(pf, OutOpts{Profile: p}); ds != nil {
+		t.Errorf("OutputDiagnostics, single tag = %v", ds)
+	}
+	if ds := OutputDiagnostics(pf, OutOpts{Formats: []string{"json"}, Profile: Profile{QuoteNote: "C1"}}); ds != nil {
+		t.Errorf("OutputDiagnostics, no RIS output = %v", ds)
+	}
+}
+
+func TestReadProfile(t *testing.T) {
+	endnote, _ := LookupProfile("endnote")
+	testCases := []struct {
+		input   string
+		wantErr bool
+		check   map[Field]string
+	}{
+		{input: "# comment\nquote.note = C1\nfile.id = -\n",
+			check: map[Field]string{QuoteNote: "C1", FileId: "", QuoteBody: "T1"}},
+		{input: "profile = standard\nquote.body = T1\n",
+			check: map[Field]string{QuoteBody: "T1", CitationYear: "PY"}},
+		{input: "quote.note = C1, C2\n", check: map[Field]string{QuoteNote: "C1,C2"}},
+		{input: "quote.bogus = C1\n", wantErr: true},
+		{input: "quote.note = c1\n", wantErr: true},
+		{input: "quote.note = TY\n", wantErr: true},
+		{input: "profile = other\n", wantErr: true},
+		{input: "quote.note C1\n", wantErr: true},
+	}
+	for n, tc := range testCases {
+		fpath := filepath.Join(t.TempDir(), "mapping.txt")
+		if err := os.WriteFile(fpath, []byte(tc.input), 0644); err != nil {
+			t.Fatal(err)
+		}
+		p, err := ReadProfile(fpath, endnote)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("failure in [%d]: error = %v", n, err)
+			continue
+		}
+		for f, tag := range tc.check {
+			if p.tag(f) != tag {
+				t.Errorf("failure in [%d]: %s = %q, want: %q", n, f, p.tag(f), tag)
+			}
+		}
+	}
+}
+
+func TestCheckRis(t *testing.T) {
+	testCases := []struct {
+		input string
+		want  []string
+	}{
+		{input: "\nTY  - BOOK\nAB  - body\nER  - \n\n"},
+		{input: "TY  - BOOK\r\nAB  - body\nER  - \r\n",
+			want: []string{"line 2: file mixes CRLF and LF line endings"}},
+		{input: "AB  - body\nTY  - BOOK\nZZ  - x\nT1 - text\nmore\nER  - x\n",
+			want: []string{
+				"line 1: AB field outside of a record; records must begin with TY",
+				"line 3: record 1: unknown tag 'ZZ'",
+				"line 4: record 1: malformed tag line; expected 'XX  - value'",
+				"line 5: record 1: untagged line continues the previous field",
+				"line 6: record 1: ER field has a value",
+			}},
+		{input: "TY  - BOOK\nAB  - a\nTY  - NONE\nAB  - b\n",
+			want: []string{
+				"line 3: record 1: record beginning on line 1 has no ER field",
+				"line 3: record 2: unknown reference type 'NONE'",
+				"line 3: record 2: record is not terminated by an ER field",
+			}},
+		{input: "TY  - BOOK\nAB  - caf\xc3\xa9 na\xc3\xafve r\xc3\xb4le\nT1  - caf\xe9\nER  - \n",
+			want: []string{"line 3: file mixes UTF-8 and ANSI encoded text"}},
+		// One ANSI character pair which is valid UTF-8 by chance.
+		{input: "TY  - BOOK\nAB  - \xc7\x9c caf\xe9\nER  - \n"},
+	}
+	for n, tc := range testCases {
+		var got []string
+		for _, p := range CheckRis([]byte(tc.input)) {
+			got = append(got, p.String())
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("failure in [%d]\ngot:  %q\nwant: %q", n, got, tc.want)
+		}
+	}
+
+	// The ANSI output of the test files passes.
+	dir := t.TempDir()
+	for _, tf := range []string{"bib22e_FUNKY.docx", "24Brown1997_Qu.docx"} {
+		pf := ProcessFile(filepath.Join("test_files", tf), InOpts{})
+		ris := filepath.Join(dir, strings.TrimSuffix(tf, ".docx")+".ris")
+		if err := writeRis(pf, ris, OutOpts{Encoding: Ansi}); err != nil {
+			t.Fatal(err)
+		}
+		ps, err := CheckRisFile(ris)
+		if err != nil || len(ps) != 0 {
+			t.Errorf("%s: %v %v", tf, ps, err)
+		}
+	}
+}
+
+func TestParseIdentifiers(t *testing.T) {
+	testCases := []struct {
+		input    string
+		wantDOI  string
+		wantISBN string
+		wantISSN string
+		wantErrs int
+		wantMsg  string
+	}{
+		{input: "Smith, J. {A Title}. Boston: Beacon, 1999. ISBN 0-8070-1429-x.",
+			wantISBN: "080701429X"},
+		{input: "Smith, J. {A Title}. Oxford UP, 2001. 978-0-19-852663-6",
+			wantISBN: "9780198526636"},
+		{input: "Smith, J. {A Title}. Oxford UP, 2001. ISBN 978-0-19-852663-7",
+			wantErrs: 1},
+		{input: "Smith, J. {A Title}. Oxford UP, 2001. ISBN 0-19-852663-66",
+			wantErrs: 1, wantMsg: "malformed"},
+		{input: `Brown, J. "T." Brain 12 (2011): 1-9. doi:10.1016/j.cortex.2011.02.009.`,
+			wantDOI: "10.1016/j.cortex.2011.02.009"},
+		{input: `Brown, J. "T." Brain 12 (2011): 1-9. https://doi.org/10.1093/brain/awr012`,
+			wantDOI: "10.1093/brain/awr012"},
+		{input: `Brown, J. "T." Brain 12 (2011): 1-9. ISSN 0006-8950.`,
+			wantISSN: "0006-8950"},
+		{input: `Brown, J. "T." Brain 12 (2011): 1-9. ISSN 0006-8951.`,
+			wantErrs: 1},
+		{input: `Brown, J. "T." Brain 12 (2011): 1-9. ISSN 0000-006x.`,
+			wantISSN: "0000-006X"},
+	}
+	for n, tc := range testCases {
+		c := Citation{Body: tc.input}
+		errs := parseIdentifiers(&c)
+		if c.DOI != tc.wantDOI || c.ISBN != tc.wantISBN || c.ISSN != tc.wantISSN ||
+			len(errs) != tc.wantErrs {
+			t.Errorf("failure in [%d]\n"+
+				"DOI, ISBN, ISSN, errors = %q, %q, %q, %v\n"+
+				"want: %q, %q, %q, %d errors",
+				n, c.DOI, c.ISBN, c.ISSN, errs, tc.wantDOI, tc.wantISBN, tc.wantISSN, tc.wantErrs)
+		}
+		if tc.wantMsg != "" && (len(errs) == 0 || !strings.Contains(errs[0].Error(), tc.wantMsg)) {
+			t.Errorf("failure in [%d]: errors = %v, want %q", n, errs, tc.wantMsg)
+		}
+	}
+	// Identifier digits are not taken for the year.
+	src := getSource("Smith, J. {A Title}. Boston: Beacon, 1999. ISBN 0-8070-1429-x.")
+	if src.Citation.Year != "1999" || src.Citation.Publisher != "Beacon" {
+		t.Errorf("getSource: year = %q, publisher = %q", src.Citation.Year, src.Citation.Publisher)
+	}
+}
+
+func TestQuoteId(t *testing.T) {
+	c := getSource(`Brown, Jason W. "Self-concept." Brain. 187 no.3 (1999e): 131-41.`).Citation
+	q := Quote{Body: []string{"The self is", "a process."}, Page: "131-41", Notes: []string{"note"}}
+	id := quoteId(c, q)
+	same := []struct {
+		c Citation
+		q Quote
+	}{
+		{c: getSource(`Brown, Jason  W. “Self-concept.” Brain. 187 no.3 (1999e): 131-41.`).Citation,
+			q: q},
+		{c: c, q: Quote{Body: []string{"the self  is a process."}, Page: "131–141"}},
+	}
+	for n, tc := range same {
+		if got := quoteId(tc.c, tc.q); got != id {
+			t.Errorf("failure in [%d]: ID = %s, want: %s", n, got, id)
+		}
+	}
+	changed := []Quote{
+		{Body: q.Body, Page: "132"},
+		{Body: []string{"The self is a processes."}, Page: q.Page},
+	}
+	for n, cq := range changed {
+		if got := quoteId(c, cq); got == id {
+			t.Errorf("failure in changed [%d]: ID unchanged", n)
+		}
+	}
+}
+
+func TestDatestamp(t *testing.T) {
+	clock := func() time.Time { return time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC) }
+	fixed := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	pf := ParsedFile{Filepath: "missing.txt"}
+	marked := Citation{Date: "2019-07"}
+	testCases := []struct {
+		outOpts OutOpts
+		c       Citation
+		want    string
+	}{
+		{outOpts: OutOpts{Clock: clock}, want: "2024/05/06"},
+		{outOpts: OutOpts{Clock: clock, DateLayout: DateLayout("YYYY-MM-DD")}, want: "2024-05-06"},
+		{outOpts: OutOpts{Clock: clock, DateSource: DateFixed, FixedDate: fixed}, want: "2020/01/02"},
+		{outOpts: OutOpts{Clock: clock, DateSource: DateMarker}, c: marked, want: "2019/07/01"},
+		{outOpts: OutOpts{Clock: clock, DateSource: DateMarker}, want: "2024/05/06"},
+		{outOpts: OutOpts{Clock: clock}, c: marked, want: "2024/05/06"},
+		// The clock stands in for a missing input file.
+		{outOpts: OutOpts{Clock: clock, DateSource: DateModTime}, want: "2024/05/06"},
+	}
+	for n, tc := range testCases {
+		if got := datestamper(pf, tc.outOpts)(tc.c); got != tc.want {
+			t.Errorf("failure in [%d]: datestamp = %s, want: %s", n, got, tc.want)
+		}
+	}
+}
+
+func TestGrammar(t *testing.T) {
+	dir := t.TempDir()
+	conf := writeTestFile(t, dir, "grammar.conf",
+		"# markers\nquote.note = abc\nkeyword = ^K:\nkeyword.separators = ;,\n")
+	g, err := ReadGrammar(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.QuoteNote != "abc" || g.Keyword != "^K:" || g.Citation != "<$>" || g.KeywordSeparators != ";," {
+		t.Errorf("ReadGrammar: %+v", g)
+	}
+
+	input := testSource +
+		"Some text.\tp. 4\n^k: mind\nA note abc.\nOld note jmr\n"
+	fpath := writeTestFile(t, dir, "quotes.txt", input)
+	pf := ProcessFile(fpath, InOpts{Grammar: g})
+	if len(pf.Sources) != 1 || len(pf.Sources[0].Quotes) != 1 {
+		t.Fatalf("ProcessFile: %+v", pf.Sources)
+	}
+	q := pf.Sources[0].Quotes[0]
+	if !slices.Equal(q.Keywords, []string{"mind"}) ||
+		!slices.Equal(q.Notes, []string{"A note abc."}) || len(pf.Discards) != 1 {
+		t.Errorf("ProcessFile: keywords = %q, note = %q, discards = %v", q.Keywords, q.Notes, pf.Discards)
+	}
+
+	invalid := []Grammar{
+		func() Grammar { g := DefaultGrammar(); g.Keyword = "##k"; return g }(),
+		func() Grammar { g := DefaultGrammar(); g.QuoteNote = "b"; return g }(), // suffix of "-nb"
+		func() Grammar { g := DefaultGrammar(); g.Supplement = ""; return g }(),
+		func() Grammar { g := DefaultGrammar(); g.Discard = "_ _"; return g }(),
+		func() Grammar { g := DefaultGrammar(); g.KeywordSeparators = ";>"; return g }(),
+	}
+	if err := DefaultGrammar().Validate(); err != nil {
+		t.Errorf("DefaultGrammar: %v", err)
+	}
+	for n, g := range invalid {
+		if g.Validate() == nil {
+			t.Errorf("failure in [%d]: conflict not reported", n)
+		}
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	dir := t.TempDir()
+	body := "About these quotes.\nCollected in 2020.\n" +
+		"<$> Smith, J. {A Title}. Boston: Beacon, 1999.\nSome text.\tp. 4\n"
+	testCases := []struct {
+		input        string
+		strict       bool
+		wantCitation string
+		wantPreamble int
+	}{
+		// Without strict mode the description is taken for a citation.
+		{input: "Title\n" + body, wantCitation: "About these quotes."},
+		{input: "Title\n" + body, strict: true,
+			wantCitation: "Smith, J. {A Title}. Boston: Beacon, 1999.", wantPreamble: 2},
+		{input: "Title\n##! strict\n" + body,
+			wantCitation: "Smith, J. {A Title}. Boston: Beacon, 1999.", wantPreamble: 2},
+	}
+	for n, tc := range testCases {
+		fpath := writeTestFile(t, dir, "quotes.txt", tc.input)
+		pf := ProcessFile(fpath, InOpts{Strict: tc.strict})
+		if len(pf.Sources) == 0 || pf.Sources[0].Citation.Body != tc.wantCitation ||
+			len(pf.Preamble) != tc.wantPreamble {
+			t.Errorf("failure in [%d]: sources = %v, preamble = %v", n, pf.Sources, pf.Preamble)
+		}
+	}
+	// New parse states do not renumber the states which existed before.
+	if got := []ParseState{Start, InSource, InMultiQuote, InQuote, Finished}; !slices.Equal(got, []ParseState{0, 1, 2, 3, 4}) {
+		t.Errorf("parse states = %v", got)
+	}
+}
+
+func TestMigrateSupplements(t *testing.T) {
+	prefix := DefaultGrammar()
+	prefix.SupplementPrefix = true
+	inOpts := InOpts{Grammar: prefix}
+	dir := t.TempDir()
+	input := "Title\r\n<$> Smith, J. {A Title}. Boston: Beacon, 1999.\r\n" +
+		"Some text.\tp. 4\r\nA supplement %%\r\n%% Already prefixed\r\n" +
+		"///A long\r\nquote 100 %%\r\nends here.\tp. 5\r\n"
+	want := "Title\r\n<$> Smith, J. {A Title}. Boston: Beacon, 1999.\r\n" +
+		"Some text.\tp. 4\r\n%% A supplement\r\n%% Already prefixed\r\n" +
+		"///A long\r\nquote 100 %%\r\nends here.\tp. 5\r\n"
+	fpath := writeTestFile(t, dir, "quotes.txt", input)
+	before := ProcessFile(fpath, InOpts{})
+	n, err := MigrateSupplements(fpath, inOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(fpath)
+	if n != 1 || string(got) != want {
+		t.Errorf("migrated %d lines:\n%q\nwant:\n%q", n, got, want)
+	}
+	after := ProcessFile(fpath, InOpts{})
+	if !reflect.DeepEqual(before.Sources, after.Sources) {
+		t.Errorf("sources changed:\n%v\n%v", before.Sources, after.Sources)
+	}
+
+	// A .docx copy keeps the formatting of the supplement paragraph and
+	// every other paragraph as it is.
+	paras := []string{
+		`<w:p><w:r><w:t>Title</w:t></w:r></w:p>`,
+		`<w:p><w:r><w:t>&lt;$&gt; Smith, J. {A Title}. Boston: Beacon, 1999.</w:t></w:r></w:p>`,
+		`<w:p><w:pPr><w:pStyle w:val="Quote"/></w:pPr><w:r><w:t>Some text.</w:t></w:r>` +
+			`<w:r><w:tab/><w:t>p. 4</w:t></w:r></w:p>`,
+		`<w:p><w:pPr><w:pStyle w:val="Note"/></w:pPr><w:r><w:rPr><w:b/></w:rPr><w:t>A</w:t></w:r>` +
+			`<w:hyperlink r:id="rId9"><w:r><w:t xml:space="preserve"> supplement</w:t></w:r></w:hyperlink>` +
+			`<w:r><w:t xml:space="preserve"> %</w:t></w:r><w:r><w:t>%</w:t></w:r></w:p>`,
+	}
+	docx := filepath.Join(dir, "quotes.docx")
+	writeTestDocx(t, docx, paras)
+	before = ProcessFile(docx, InOpts{})
+	if n, err := MigrateSupplements(docx, inOpts); n != 1 || err != nil {
+		t.Fatalf("migrated %d paragraphs: %v", n, err)
+	}
+	migrated := MigratedPath(docx)
+	after = ProcessFile(migrated, InOpts{})
+	if !reflect.DeepEqual(before.Sources, after.Sources) || len(after.suffixSupps) != 0 {
+		t.Errorf("sources changed:\n%v\n%v", before.Sources, after.Sources)
+	}
+	doc := readTestDocx(t, migrated)
+	wantPara := `<w:p><w:pPr><w:pStyle w:val="Note"/></w:pPr><w:r><w:rPr><w:b/></w:rPr><w:t>%% A</w:t></w:r>` +
+		`<w:hyperlink r:id="rId9"><w:r><w:t xml:space="preserve"> supplement</w:t></w:r></w:hyperlink>` +
+		`<w:r><w:t xml:space="preserve"></w:t></w:r><w:r><w:t></w:t></w:r></w:p>`
+	if !strings.Contains(doc, strings.Join(paras[:3], "")+wantPara) {
+		t.Errorf("migrated document:\n%s", doc)
+	}
+
+	// Nothing to migrate, so no copy is written.
+	os.Remove(migrated)
+	writeTestDocx(t, docx, paras[:3])
+	if n, err := MigrateSupplements(docx, inOpts); n != 0 || err != nil {
+		t.Errorf("migrated %d paragraphs: %v", n, err)
+	}
+	if _, err := os.Stat(migrated); err == nil {
+		t.Errorf("copy written with nothing to migrate")
+	}
+
+	// With the suffix form canonical, prefix supplements are migrated to it.
+	fpath = writeTestFile(t, dir, "prefixed.txt", testSource+
+		"Some text.\tp. 4\n%% A supplement\nAlready suffixed %%\n")
+	if n, err := MigrateSupplements(fpath, InOpts{}); n != 1 || err != nil {
+		t.Errorf("migrated %d lines: %v", n, err)
+	}
+	got, _ = os.ReadFile(fpath)
+	if want := testSource + "Some text.\tp. 4\nA supplement %%\nAlready suffixed %%\n"; string(got) != want {
+		t.Errorf("migrated:\n%q\nwant:\n%q", got, want)
+	}
+	writeTestDocx(t, docx, append(paras[:3:3],
+		`<w:p><w:r><w:t>%</w:t></w:r><w:r><w:t xml:space="preserve">% A </w:t></w:r>`+
+			`<w:r><w:rPr><w:i/></w:rPr><w:t>supplement</w:t></w:r></w:p>`))
+	if n, err := MigrateSupplements(docx, InOpts{}); n != 1 || err != nil {
+		t.Fatalf("migrated %d paragraphs: %v", n, err)
+	}
+	doc = readTestDocx(t, migrated)
+	wantPara = `<w:p><w:r><w:t></w:t></w:r><w:r><w:t xml:space="preserve">A </w:t></w:r>` +
+		`<w:r><w:rPr><w:i/></w:rPr><w:t>supplement %%</w:t></w:r></w:p>`
+	if !strings.Contains(doc, wantPara) {
+		t.Errorf("migrated document:\n%s", doc)
+	}
+
+	ls := quoteMarkup(Quote{Body: []string{"text"}, Page: "4", Supp: []string{"see"}}, prefix.compile())
+	if ls[1].Body != "%% see" {
+		t.Errorf("prefix canonical form: %q", ls[1].Body)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	dir := t.TempDir()
+	input := testSource +
+		"-nb{ A citation note\nwhich wraps.\n}\n" +
+		"Some text.\tp. 4\njmr{\nA long commentary\n## skipped\n\nover two lines.\n}\n" +
+		"%%{\nSee also\np. 7 of the same.\n}\n" +
+		"More text.\tp. 5\njmr{\nNever\nclosed.\n"
+	fpath := writeTestFile(t, dir, "quotes.txt", input)
+	pf := ProcessFile(fpath, InOpts{})
+	if len(pf.Sources) != 1 || len(pf.Sources[0].Quotes) != 2 {
+		t.Fatalf("sources = %v", pf.Sources)
+	}
+	s := pf.Sources[0]
+	if s.Citation.Note != "A citation note\nwhich wraps." {
+		t.Errorf("citation note = %q", s.Citation.Note)
+	}
+	q := s.Quotes[0]
+	if !slices.Equal(q.Notes, []string{"A long commentary\nover two lines."}) ||
+		!slices.Equal(q.Supp, []string{"See also\np. 7 of the same."}) {
+		t.Errorf("notes = %q, supplements = %q", q.Notes, q.Supp)
+	}
+	if len(pf.Discards) != 0 || len(pf.Diagnostics) != 1 || pf.Diagnostics[0].Line.LineNo != 18 {
+		t.Errorf("discards = %v, diagnostics = %v", pf.Discards, pf.Diagnostics)
+	}
+
+	vs := quoteValues(s, q, nil)
+	if !slices.Equal(vs[QuoteNote], []string{"A long commentary over two lines."}) {
+		t.Errorf("RIS note = %q", vs[QuoteNote])
+	}
+
+	// A block may close on its opening line, and a citation ends a block
+	// which was left open.
+	input = testSource +
+		"Some text.\tp. 4\njmr{A short note}\njmr{See {Another Title}\nfor more.\n}\n" +
+		"%%{Never closed\n<$> Jones, K. {B Title}. Boston: Beacon, 2001.\nMore text.\tp. 5\n"
+	fpath = writeTestFile(t, dir, "oneline.txt", input)
+	one := ProcessFile(fpath, InOpts{})
+	if len(one.Sources) != 2 || len(one.Sources[1].Quotes) != 1 {
+		t.Fatalf("sources = %v", one.Sources)
+	}
+	q = one.Sources[0].Quotes[0]
+	if !slices.Equal(q.Notes, []string{"A short note", "See {Another Title}\nfor more."}) ||
+		!slices.Equal(q.Supp, []string{"Never closed"}) {
+		t.Errorf("notes = %q, supplements = %q", q.Notes, q.Supp)
+	}
+	if len(one.Diagnostics) != 1 || one.Diagnostics[0].Code != CodeUnclosedBlock ||
+		one.Diagnostics[0].Line.LineNo != 8 {
+		t.Errorf("diagnostics = %v", one.Diagnostics)
+	}
+
+	checkRoundTrip(t, dir, pf)
+}
+
+func TestSourceDefaults(t *testing.T) {
+	dir := t.TempDir()
+	input := testSource +
+		">>> Jones, K.\n^S: Stoics\nhttps://example.com/book\n" +
+		"Some text.\tp. 4\n" +
+		"More text.\tp. 5\n>>> Brown, L.\n^S: memory\nhttps://example.com/p5\n"
+	fpath := writeTestFile(t, dir, "quotes.txt", input)
+	pf := ProcessFile(fpath, InOpts{})
+	if len(pf.Sources) != 1 || len(pf.Discards) != 0 {
+		t.Fatalf("sources = %v, discards = %v", pf.Sources, pf.Discards)
+	}
+	s := pf.Sources[0]
+	testCases := []struct {
+		q        Quote
+		wantAuth string
+		wantKw   []string
+		wantUrl  string
+	}{
+		{q: s.Quotes[0], wantAuth: "Jones, K.", wantKw: []string{"Stoics"},
+			wantUrl: "https://example.com/book"},
+		{q: s.Quotes[1], wantAuth: "Brown, L.", wantKw: []string{"Stoics", "memory"},
+			wantUrl: "https://example.com/p5"},
+	}
+	for n, tc := range testCases {
+		vs := quoteValues(s, tc.q, nil)
+		if !slices.Equal(vs[QuoteAuthor], []string{tc.wantAuth}) ||
+			!slices.Equal(vs[QuoteKeyword], tc.wantKw) ||
+			!slices.Equal(vs[QuoteUrl], []string{tc.wantUrl}) {
+			t.Errorf("failure in [%d]: author = %q, keywords = %q, url = %q",
+				n, vs[QuoteAuthor], vs[QuoteKeyword], vs[QuoteUrl])
+		}
+	}
+
+	checkRoundTrip(t, dir, pf)
+}
+
+func TestSplitKeywords(t *testing.T) {
+	testCases := []struct {
+		input      string
+		separators string
+		want       []string
+	}{
+		{input: "self; memory;  Greek   tragedy ;", separators: ";",
+			want: []string{"self", "memory", "Greek tragedy"}},
+		{input: "self, memory; mind", separators: ";,", want: []string{"self", "memory", "mind"}},
+		{input: "Psychology>Self ; Philosophy >  > Mind", separators: ";",
+			want: []string{"Psychology > Self", "Philosophy > Mind"}},
+		{input: "self; memory", separators: "", want: []string{"self; memory"}},
+	}
+	for n, tc := range testCases {
+		if kws := splitKeywords(tc.input, tc.separators); !slices.Equal(kws, tc.want) {
+			t.Errorf("failure in [%d]: keywords = %q, want: %q", n, kws, tc.want)
+		}
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	kws := keywordAncestors([]string{"Psychology > Self > Memory", "Stoics"})
+	want := []string{"Psychology", "Psychology > Self", "Psychology > Self > Memory", "Stoics"}
+	if !slices.Equal(kws, want) {
+		t.Errorf("ancestors = %q, want: %q", kws, want)
+	}
+
+	dir := t.TempDir()
+	input := testSource + "^S: Psychology > Self\n" +
+		"Some text.\tp. 4\n^S: self; memory\n^S: Psychology > Memory\n"
+	fpath := writeTestFile(t, dir, "quotes.txt", input)
+	pf := ProcessFile(fpath, InOpts{})
+	ris := filepath.Join(dir, "quotes.ris")
+	if err := writeRis(pf, ris, OutOpts{KeywordAncestors: true}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(ris)
+	var got []string
+	for _, line := range strings.Split(string(data), LineEnding) {
+		if kw, ok := strings.CutPrefix(line, "KW  - "); ok {
+			got = append(got, kw)
+		}
+	}
+	want = []string{"Psychology", "Psychology > Self", "self", "memory", "Psychology > Memory"}
+	if !slices.Equal(got, want) {
+		t.Errorf("KW = %q, want: %q", got, want)
+	}
+}
+
+func TestTranslations(t *testing.T) {
+	dir := t.TempDir()
+	input := testSource + "^LA: de\n" +
+		"Das Selbst ist ein Verhältnis.\tp. 4\n^TR: The self is a relation.\n" +
+		"The soul is a harmony.\tp. 5\n^LA: en\n^OR:{\nἡ ψυχὴ\nἁρμονία ἐστίν\n}\n"
+	fpath := writeTestFile(t, dir, "quotes.txt", input)
+	pf := ProcessFile(fpath, InOpts{})
+	if len(pf.Sources) != 1 || len(pf.Sources[0].Quotes) != 2 || len(pf.Discards) != 0 {
+		t.Fatalf("sources = %v, discards = %v", pf.Sources, pf.Discards)
+	}
+	s := pf.Sources[0]
+	endnote, _ := LookupProfile("endnote")
+	testCases := []struct {
+		q    Quote
+		want map[string]string
+	}{
+		{q: s.Quotes[0], want: map[string]string{"TT": "The self is a relation.", "C8": "", "LA": "de"}},
+		{q: s.Quotes[1], want: map[string]string{"TT": "", "C8": "ἡ ψυχὴ ἁρμονία ἐστίν", "LA": "en"}},
+	}
+	for n, tc := range testCases {
+		fs, _ := quoteFields(quoteValues(s, tc.q, nil), endnote)
+		got := map[string]string{"TT": "", "C8": "", "LA": ""}
+		for _, f := range fs {
+			if _, ok := got[f.Tag]; ok {
+				got[f.Tag] = f.Value
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("failure in [%d]: fields = %v, want: %v", n, got, tc.want)
+		}
+	}
+
+	checkRoundTrip(t, dir, pf)
+}
+
+func TestGetDirective(t *testing.T) {
+	testCases := []struct {
+		input      string
+		key, value string
+		ok         bool
+	}{
+		{input: "##! strict", key: "strict", ok: true},
+		{input: "##!Profile = Standard", key: "profile", value: "Standard", ok: true},
+		{input: "##! keyword = Stoics; ethics", key: "keyword", value: "Stoics; ethics", ok: true},
+		{input: "##! quote.note=a=b", key: "quote.note", value: "a=b", ok: true},
+		{input: "## a comment", ok: false},
+		{input: "##", ok: false},
+	}
+	for n, tc := range testCases {
+		key, value, ok := getDirective(tc.input, defaultGrammar)
+		if key != tc.key || value != tc.value || ok != tc.ok {
+			t.Errorf("failure in [%d]: getDirective = %q, %q, %v", n, key, value, ok)
+		}
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	dir := t.TempDir()
+	input := "Title\n##! enc = utf8\n##! Profile=Standard\n##! batch = Stoics\n" +
+		"##! keyword = Stoics; ethics\n##! quote.note = abc\n##! bogus = 1\n##! enc = klingon\n" +
+		"<$> Smith, J. {A Title}. Boston: Beacon, 1999.\n##! strict\n" +
+		"Some text.\tp. 4\nA note abc\n^S: ethics\n"
+	fpath := writeTestFile(t, dir, "quotes.txt", input)
+	pf := ProcessFile(fpath, InOpts{})
+	if len(pf.Sources) != 1 || len(pf.Sources[0].Quotes) != 1 || len(pf.Discards) != 0 {
+		t.Fatalf("sources = %v, discards = %v", pf.Sources, pf.Discards)
+	}
+	var msgs []string
+	for _, w := range pf.Diagnostics {
+		msgs = append(msgs, w.Msg)
+	}
+	wantMsgs := []string{"unknown directive 'bogus'", "directive enc: unknown encoding 'klingon'",
+		"strict directive must precede the first citation"}
+	if !slices.Equal(msgs, wantMsgs) {
+		t.Errorf("warnings = %q, want: %q", msgs, wantMsgs)
+	}
+	s := pf.Sources[0]
+	if !slices.Equal(s.Keywords, []string{"Stoics", "ethics"}) ||
+		!slices.Equal(s.Quotes[0].Notes, []string{"A note abc"}) || pf.Grammar.QuoteNote != "abc" {
+		t.Errorf("keywords = %q, notes = %q", s.Keywords, s.Quotes[0].Notes)
+	}
+	if kws := quoteValues(s, s.Quotes[0], nil)[QuoteKeyword]; !slices.Equal(kws, []string{"Stoics", "ethics"}) {
+		t.Errorf("quote keywords = %q", kws)
+	}
+
+	outOpts, ds := pf.fileOutOpts(OutOpts{Encoding: Ansi})
+	standard, _ := LookupProfile("standard")
+	if outOpts.Encoding != Utf8 || !reflect.DeepEqual(outOpts.Profile, standard) ||
+		!outOpts.Volume || outOpts.Batch != "Stoics" || len(ds) != 0 {
+		t.Errorf("outOpts = %+v, diagnostics = %v", outOpts, ds)
+	}
+
+	// A mapping file is applied over the profile of the directive.
+	mpath := writeTestFile(t, dir, "mapping.conf", "quote.body = T1\n")
+	outOpts, ds = pf.fileOutOpts(OutOpts{Mapping: mpath})
+	if outOpts.Profile.tag(QuoteBody) != "T1" || outOpts.Profile.tag(CitationYear) != standard.tag(CitationYear) {
+		t.Errorf("profile with mapping = %v, diagnostics = %v", outOpts.Profile, ds)
+	}
+
+	// A directive which cannot be applied is reported, not ignored.
+	bad := writeTestFile(t, dir, "bad.conf", "quote.body = ?\n")
+	ds = OutputDiagnostics(pf, OutOpts{Mapping: bad})
+	if len(ds) != 1 || ds[0].Code != CodeInvalidDirective || ds[0].Line.LineNo != 3 {
+		t.Errorf("diagnostics = %v", ds)
+	}
+}
+
+func TestTitle(t *testing.T) {
+	dir := t.TempDir()
+	body := "<$> Smith, J. {A Title}. Boston: Beacon, 1999.\nSome text.\tp. 4\n"
+	testCases := []struct {
+		input     string
+		noTitle   bool
+		wantTitle string
+	}{
+		{input: "  Stoic Ethics Project \n" + body, wantTitle: "Stoic Ethics Project"},
+		{input: body, noTitle: true},
+	}
+	for n, tc := range testCases {
+		fpath := writeTestFile(t, dir, "quotes.txt", tc.input)
+		pf := ProcessFile(fpath, InOpts{NoTitle: tc.noTitle})
+		if pf.Title != tc.wantTitle || len(pf.Sources) != 1 || len(pf.Sources[0].Quotes) != 1 {
+			t.Errorf("failure in [%d]: title = %q, sources = %v", n, pf.Title, pf.Sources)
+		}
+	}
+
+	standard, _ := LookupProfile("standard")
+	endnote, _ := LookupProfile("endnote")
+	src := getSource("Smith, J. {A Title}. Boston: Beacon, 1999.")
+	vs := quoteValues(src, Quote{Body: []string{"text"}, Page: "4"}, map[Field]string{FileTitle: "Stoics"})
+	fs, _ := quoteFields(vs, standard)
+	if !slices.Contains(fs, RisField{Tag: "T3", Value: "Stoics"}) {
+		t.Errorf("standard: fields = %v", fs)
+	}
+	fs, _ = quoteFields(vs, endnote)
+	for _, f := range fs {
+		if f.Value == "Stoics" {
+			t.Errorf("endnote: title written as %s", f.Tag)
+		}
+	}
+	if title := fileTitle(ParsedFile{Filepath: "/a/quotes.txt"}); title != "quotes" {
+		t.Errorf("fileTitle = %q", title)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	input := testSource +
+		"A stray note jmr\n" +
+		"Some text  p. 12\n" +
+		"Some text.\tp.12\n" +
+		"Some text.\tp. 4\n" +
+		"__ set aside\n" +
+		"}\n" +
+		"A late citation note -nb\n" +
+		"^TY: NONE\n" +
+		"Just words.\n"
+	fpath := writeTestFile(t, dir, "quotes.txt", input)
+	pf := ProcessFile(fpath, InOpts{})
+	want := []struct {
+		lineNo      int
+		code        string
+		sev         Severity
+		col, endCol int
+	}{
+		{3, CodeNoteBeforeQuote, SevError, 1, 16},
+		{4, CodePageSeparator, SevError, 10, 16},
+		{5, CodePageSpace, SevError, 12, 15},
+		{7, CodeMarkedDiscard, SevInfo, 1, 12},
+		{8, CodeStrayBlockClose, SevError, 1, 1},
+		{9, CodeNoteAfterQuote, SevError, 1, 24},
+		{10, CodeUnknownType, SevError, 1, 9},
+		{11, CodeUnknownLine, SevError, 1, 11},
+	}
+	if len(pf.Diagnostics) != len(want) || len(pf.Discards) != len(want) {
+		t.Fatalf("diagnostics = %v", pf.Diagnostics)
+	}
+	for n, w := range want {
+		d := pf.Diagnostics[n]
+		if d.Line.LineNo != w.lineNo || d.Code != w.code || d.Severity != w.sev ||
+			d.Col != w.col || d.EndCol != w.endCol {
+			t.Errorf("failure in [%d]: %v", n, d)
+		}
+	}
+	if msg := pf.Diagnostics[1].Msg; !strings.Contains(msg, "two spaces") {
+		t.Errorf("page separator: %s", msg)
+	}
+
+	fname := filepath.Join(dir, "quotes"+diagnosticsSuffix)
+	if err := writeDiagnostics(pf, fname, OutOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(fname)
+	if !strings.Contains(string(data), `"Severity": "info"`) {
+		t.Errorf("JSON diagnostics: %s", data)
+	}
+
+	// Only discarded lines are written to a _DISCARD file.
+	testCases := []struct {
+		name, input, want string
+	}{
+		{name: "warned.txt", input: "Title\n<$> Smith, J. {A Title}.\nSome text.\tp. 4\n"},
+		{name: "discarded.txt", input: "Title\n<$> Smith, J. {A Title}.\nSome text.\tp. 4\nJust words.\n",
+			want: "< 4 >\nJust words.\n  error D001, col 1-11: "},
+	}
+	for n, tc := range testCases {
+		fpath := writeTestFile(t, dir, tc.name, tc.input)
+		pf := ProcessFile(fpath, InOpts{})
+		if len(pf.Diagnostics) == 0 {
+			t.Fatalf("failure in [%d]: no diagnostics", n)
+		}
+		WriteResults([]ParsedFile{pf}, OutOpts{Formats: []string{"json"}})
+		data, err := os.ReadFile(strings.TrimSuffix(fpath, ".txt") + discardSuffix)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("failure in [%d]: _DISCARD written:\n%s", n, data)
+		case tc.want != "" && !strings.HasPrefix(string(data), tc.want):
+			t.Errorf("failure in [%d]: _DISCARD = %q, want prefix %q", n, data, tc.want)
+		}
+	}
+}
+
+func TestNearMarker(t *testing.T) {
+	testCases := []struct {
+		s, m string
+		near bool
+	}{
+		{"jrm", "jmr", true},
+		{"JMR", "jmr", true},
+		{"<S>", "<$>", true},
+		{"<$$>", "<$>", true},
+		{"–nb", "-nb", true},
+		{"^S;", "^S:", true},
+		{"jar", "jmr", false},
+		{"jm", "jmr", false},
+		{"<$>>>", "<$>", false},
+		{"nb", "-nb", true},
+		{"5%", "%%", false},
+		{"1>>", ">>>", false},
+		{"<1$>", "<$>", false},
+		{"jm r", "jmr", false},
+		{"jmr", "jmr", true},
+	}
+	for n, tc := range testCases {
+		if got := nearMarker(tc.s, tc.m); got != tc.near {
+			t.Errorf("failure in [%d]: nearMarker(%q, %q) = %v", n, tc.s, tc.m, got)
+		}
+	}
+}
+
+func TestFixes(t *testing.T) {
+	dir := t.TempDir()
+	input := "Title\r\n<S> Smith, J. {A Title}. Boston: Beacon, 1999.\r\n" +
+		"Some text  p. 12\r\n" +
+		"Some text.\tp.12\r\n" +
+		"Some text.\tp. 13\r\n" +
+		"A note jrm\r\n" +
+		"^S; Stoics\r\n" +
+		"Just words.\r\n"
+	fpath := writeTestFile(t, dir, "quotes.txt", input)
+	pf := ProcessFile(fpath, InOpts{})
+	want := []struct {
+		lineNo int
+		code   string
+		fix    string
+	}{
+		{2, CodeNearCitation, "<$> Smith, J. {A Title}. Boston: Beacon, 1999."},
+		{3, CodePageSeparator, "Some text\tp. 12"},
+		{4, CodePageSpace, "Some text.\tp. 12"},
+		{6, CodeNearMiss, "A note jmr"},
+		{7, CodeNearMiss, "^S: Stoics"},
+		{8, CodeUnknownLine, ""},
+	}
+	if len(pf.Diagnostics) != len(want) {
+		t.Fatalf("diagnostics = %v", pf.Diagnostics)
+	}
+	for n, w := range want {
+		d := pf.Diagnostics[n]
+		if d.Line.LineNo != w.lineNo || d.Code != w.code || d.Fix != w.fix {
+			t.Errorf("failure in [%d]: %v, fix %q", n, d, d.Fix)
+		}
+	}
+
+	// An earlier backup is kept.
+	writeTestFile(t, dir, "quotes.txt"+backupSuffix, "earlier")
+	results, err := FixQuoteFiles(dir, []string{"quotes.txt"}, InOpts{},
+		func(string, []Diagnostic) bool { return true })
+	if err != nil || len(results) != 1 {
+		t.Fatalf("FixQuoteFiles = %v, %v", results, err)
+	}
+	r := results[0]
+	if r.Fixed != len(r.Fixes) || r.Fixed != len(pf.Fixes()) || r.Backup != fpath+".1"+backupSuffix {
+		t.Errorf("result = %+v", r)
+	}
+	if backup, _ := os.ReadFile(r.Backup); string(backup) != input {
+		t.Errorf("backup: %q", backup)
+	}
+	if earlier, _ := os.ReadFile(fpath + backupSuffix); string(earlier) != "earlier" {
+		t.Errorf("earlier backup: %q", earlier)
+	}
+	data, _ := os.ReadFile(fpath)
+	if !strings.Contains(string(data), "A note jmr\r\n^S: Stoics\r\n") {
+		t.Errorf("fixed file: %q", data)
+	}
+	if ds := ProcessFile(fpath, InOpts{}).Diagnostics; len(ds) != 1 {
+		t.Errorf("diagnostics after fixes = %v", ds)
+	}
+}
+
+// `testSource` begins the quote files of the tests with a title and a
+// citation.
+const testSource = "Title\n<$> Smith, J. {A Title}. Boston: Beacon, 1999.\n"
+
+// `writeTestFile` writes `data` to the file `name` in `dir` and returns its
+// path.
+func writeTestFile(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	fpath := filepath.Join(dir, name)
+	if err := os.WriteFile(fpath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fpath
+}
+
+// `checkRoundTrip` writes the sources of `pf` as a canonical quote file in
+// `dir` and checks that they are parsed from it unchanged.
+func checkRoundTrip(t *testing.T, dir string, pf ParsedFile) {
+	t.Helper()
+	canon := filepath.Join(dir, "canonical.txt")
+	if err := WriteQuoteFile("Title", pf.Sources, canon); err != nil {
+		t.Fatal(err)
+	}
+	if again := ProcessFile(canon, InOpts{}); !reflect.DeepEqual(again.Sources, pf.Sources) {
+		t.Errorf("round trip: %v, want: %v", again.Sources, pf.Sources)
+	}
+}
+
+// `writeTestDocx` writes a .docx file whose body holds the paragraphs `ps`.
+func writeTestDocx(t *testing.T, fname string, ps []string) {
+	t.Helper()
+	file, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zw := zip.NewWriter(file)
+	w, err := zw.Create("word/document.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><w:body>` +
+		strings.Join(ps, "") + `</w:body></w:document>`
+	if _, err := w.Write([]byte(doc)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// `readTestDocx` returns the document part of the .docx file `fname`.
+func readTestDocx(t *testing.T, fname string) string {
+	t.Helper()
+	r, err := zip.OpenReader(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f, err := r.Open("word/document.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,46 @@
+// recordid.go
+//
+// Stable record identifiers.
+//
+// Each quote is given an ID computed from its citation, page, and text, so
+// that processing the same quote file again yields the same IDs and EndNote
+// can recognize records which were imported before. The ID is written to the
+// `ID` tag by default; it may be moved to another tag or dropped with the
+// "quote.id" field of a mapping file.
+//
+// Only the content of a quote determines its ID. Moving a quote within a
+// file or to another file, reordering sources, and changes to letter case,
+// spacing, typographic quotes and dashes, or the notation of the page group
+// ("131-41" or "131–141") leave the ID unchanged. Any other edit to the
+// citation, the page, or the text of a quote gives it a new ID, so that the
+// revised quote is imported as a new record and the earlier record must be
+// removed by hand. Notes, supplements, keywords, and URLs are not part of the
+// ID and may be edited freely.
+package qris
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// `normalizeForId` reduces `s` to lower case ASCII with single spaces.
+func normalizeForId(s string) string {
+	s = utf8ToNormalized(s, utf8ToAscii())
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// `quoteId` returns the stable ID of quote `q` from the source with citation
+// `c`: "qris-" followed by 16 hexadecimal digits.
+func quoteId(c Citation, q Quote) string {
+	page := q.Page
+	if loc, err := parseLocator(page); err == nil {
+		page = loc.String()
+	}
+	h := sha256.New()
+	for _, part := range []string{c.Body, page, strings.Join(q.Body, "\n")} {
+		h.Write([]byte(normalizeForId(part)))
+		h.Write([]byte{0}) // separates parts so that text cannot shift between them
+	}
+	return "qris-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,272 @@
+// ris.go
+//
+// Read RIS files and convert RIS records back into quote sources.
+//
+// RIS files written by `WriteQuotes` use an EndNote-specific layout in which
+// several tags are repurposed (see the "endnote" `Profile`). `RisToSources`
+// reverses that layout so that legacy EndNote exports can be regenerated as
+// qris quote files.
+package qris
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A RIS tag line: two character tag, two spaces, a dash, and an optional
+// value separated from the dash by a single space.
+var risTagLine = regexp.MustCompile(`^([A-Z][A-Z0-9])  -(?: (.*))?$`)
+
+// A `RisField` is one tagged line of a RIS record. `LineNo` refers to the
+// line of the RIS file on which the field began; 1-indexed.
+type RisField struct {
+	Tag    string
+	Value  string
+	LineNo int
+}
+
+// A `RisRecord` is the sequence of fields from a `TY` line through the
+// matching `ER` line.
+type RisRecord struct {
+	LineNo int
+	Fields []RisField
+}
+
+// `Values` returns the values of all fields in `r` tagged `tag`, in order.
+func (r RisRecord) Values(tag string) []string {
+	var vs []string
+	for _, f := range r.Fields {
+		if f.Tag == tag {
+			vs = append(vs, f.Value)
+		}
+	}
+	return vs
+}
+
+// `Value` returns the value of the first field in `r` tagged `tag`, or the
+// empty string if there is no such field.
+func (r RisRecord) Value(tag string) string {
+	for _, f := range r.Fields {
+		if f.Tag == tag {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// `ansiToUtf8` inverts `utf8ToAnsi`. Bytes above 0x7F which are not in the
+// table are Latin-1 code points.
+func ansiToUtf8(data []byte) string {
+	table := map[byte]rune{}
+	for r, s := range utf8ToAnsi() {
+		table[s[0]] = r
+	}
+	var b strings.Builder
+	for _, c := range data {
+		if c < 0x80 {
+			b.WriteByte(c)
+		} else if r, ok := table[c]; ok {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+// `decodeUtf16` decodes `data` as UTF-16 with the given byte order.
+func decodeUtf16(data []byte, order binary.ByteOrder) string {
+	codePoints := make([]uint16, len(data)/2)
+	for i := range codePoints {
+		codePoints[i] = order.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(codePoints))
+}
+
+// `decodeRis` guesses the encoding of `data` and returns its content as a
+// UTF-8 string together with the detected `Encoding`. Files written by
+// `WriteQuotes` carry no byte order mark, so UTF-16 is recognized by the
+// position of zero bytes in the data.
+func decodeRis(data []byte) (string, Encoding) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:]), Utf8
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return decodeUtf16(data[2:], binary.LittleEndian), Utf16
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return decodeUtf16(data[2:], binary.BigEndian), Utf16
+	}
+	evenZeros, oddZeros := 0, 0
+	for i, c := range data {
+		if c == 0 {
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+	}
+	half := len(data) / 4 // a quarter of all bytes; half of one byte lane
+	switch {
+	case oddZeros > half:
+		return decodeUtf16(data, binary.LittleEndian), Utf16
+	case evenZeros > half:
+		return decodeUtf16(data, binary.BigEndian), Utf16
+	case utf8.Valid(data):
+		return string(data), Utf8
+	default:
+		return ansiToUtf8(data), Ansi
+	}
+}
+
+// `ParseRis` splits the decoded content of a RIS file into records. Lines
+// outside of records are ignored, and untagged lines inside a record are
+// treated as continuations of the preceding field.
+func ParseRis(content string) []RisRecord {
+	var recs []RisRecord
+	var cur *RisRecord
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	for n, line := range strings.Split(content, "\n") {
+		lineNo := n + 1
+		m := risTagLine.FindStringSubmatch(line)
+		if m == nil {
+			if cur != nil && len(cur.Fields) > 0 && strings.TrimSpace(line) != "" {
+				last := &cur.Fields[len(cur.Fields)-1]
+				last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(line))
+			}
+			continue
+		}
+		tag, value := m[1], strings.TrimSpace(m[2])
+		if tag == "TY" {
+			recs = append(recs, RisRecord{LineNo: lineNo})
+			cur = &recs[len(recs)-1]
+		}
+		if cur == nil {
+			continue
+		}
+		cur.Fields = append(cur.Fields, RisField{Tag: tag, Value: value, LineNo: lineNo})
+		if tag == "ER" {
+			cur = nil
+		}
+	}
+	return recs
+}
+
+// `ReadRis` reads and parses the RIS file at `fpath`.
+func ReadRis(fpath string) ([]RisRecord, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	content, _ := decodeRis(data)
+	return ParseRis(content), nil
+}
+
+// `risCitationBody` returns the raw citation of `r`. Records written by qris
+// keep the citation in `AB`; for other records a citation is assembled from
+// the author, title, and year fields.
+func risCitationBody(r RisRecord) string {
+	if ab := r.Value("AB"); ab != "" {
+		return ab
+	}
+	var parts []string
+	if names := r.Values("AU"); len(names) > 0 {
+		parts = append(parts, strings.Join(names, "; ")+".")
+	} else if name := r.Value("A1"); name != "" {
+		parts = append(parts, name+".")
+	}
+	if title := r.Value("TI"); title != "" {
+		parts = append(parts, "{"+title+"}.")
+	}
+	year := r.Value("PY")
+	if year == "" {
+		year = r.Value("Y1")
+	}
+	if year != "" {
+		parts = append(parts, year+".")
+	}
+	return strings.Join(parts, " ")
+}
+
+// `risPage` joins the `SP` and `EP` fields of `r` into a page group. Quotes
+// written without a page had an unknown page number.
+func risPage(r RisRecord) string {
+	sp, ep := r.Value("SP"), r.Value("EP")
+	switch {
+	case sp == "":
+		return "?"
+	case ep == "":
+		return sp
+	default:
+		return sp + "–" + ep
+	}
+}
+
+// `risQuote` rebuilds a `Quote` from a record written in the EndNote layout.
+func risQuote(r RisRecord) Quote {
+	q := Quote{
+		Body: r.Values("T1"),
+		Page: risPage(r),
+		Supp: r.Values("PB"),
+	}
+	endnote, _ := LookupProfile("endnote")
+	for _, tag := range endnote.tags(QuoteNote) {
+		q.Notes = append(q.Notes, r.Values(tag)...)
+	}
+	q.Keywords = r.Values("KW")
+	q.Translation = r.Value("TT")
+	q.Original = r.Value("C8")
+	q.Lang = r.Value("LA")
+	// A secondary author of the form "in Name" marks a quote author.
+	if strings.HasPrefix(r.Value("A2"), "in ") {
+		q.Auth = r.Value("A1")
+	}
+	// The first `UR` field holds the file ID; only real URLs are kept.
+	for _, u := range r.Values("UR") {
+		if urlLine.MatchString(u) {
+			q.Url = u
+		}
+	}
+	return q
+}
+
+// `RisToSources` groups `recs` by citation into `Source`s, preserving the
+// order in which citations first appear.
+func RisToSources(recs []RisRecord) []Source {
+	var srcs []Source
+	index := map[string]int{}
+	for _, r := range recs {
+		body := risCitationBody(r)
+		n, ok := index[body]
+		if !ok {
+			src := getSource(body)
+			src.Citation.Note = r.Value("T2")
+			// Keep the record type if it was not inferred or defaulted.
+			if ty := r.Value("TY"); risTypes[ty] && ty != DefaultType {
+				src.Citation.Type = ty
+			}
+			srcs = append(srcs, src)
+			n = len(srcs) - 1
+			index[body] = n
+		}
+		srcs[n].Quotes = append(srcs[n].Quotes, risQuote(r))
+	}
+	return srcs
+}
+
+// `RisToQuoteFile` converts the RIS file at `fpath` into a quote file at
+// `fname`. The title line of the quote file is the base name of `fpath`.
+func RisToQuoteFile(fpath, fname string) error {
+	recs, err := ReadRis(fpath)
+	if err != nil {
+		return err
+	}
+	title := strings.TrimSuffix(filepath.Base(fpath), filepath.Ext(fpath))
+	return WriteQuoteFile(title, RisToSources(recs), fname)
+}
@@ -0,0 +1,214 @@
+// rischeck.go
+//
+// Validate RIS files before they are imported into a reference manager.
+//
+// `CheckRis` reports tag lines which do not have the form `XX  - value`,
+// records which do not begin with `TY` and end with `ER`, tags which are not
+// defined by the RIS specification, text which mixes encodings, and files
+// which mix line endings.
+package qris
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tags defined by the RIS specification, including the legacy tags which
+// EndNote still reads and writes.
+var risTags = map[string]bool{
+	"A1": true, "A2": true, "A3": true, "A4": true, "AB": true, "AD": true,
+	"AN": true, "AU": true, "AV": true, "BT": true, "C1": true, "C2": true,
+	"C3": true, "C4": true, "C5": true, "C6": true, "C7": true, "C8": true,
+	"CA": true, "CN": true, "CP": true, "CT": true, "CY": true, "DA": true,
+	"DB": true, "DO": true, "DP": true, "ED": true, "EP": true, "ER": true,
+	"ET": true, "ID": true, "IS": true, "J1": true, "J2": true, "JA": true,
+	"JF": true, "JO": true, "KW": true, "L1": true, "L2": true, "L3": true,
+	"L4": true, "LA": true, "LB": true, "LK": true, "M1": true, "M2": true,
+	"M3": true, "N1": true, "N2": true, "NV": true, "OP": true, "PB": true,
+	"PP": true, "PY": true, "RI": true, "RN": true, "RP": true, "SE": true,
+	"SN": true, "SP": true, "ST": true, "T1": true, "T2": true, "T3": true,
+	"TA": true, "TI": true, "TT": true, "TY": true, "U1": true, "U2": true,
+	"U3": true, "U4": true, "U5": true, "UR": true, "VL": true, "VO": true,
+	"Y1": true, "Y2": true,
+}
+
+// A line which was probably meant to be a tag line, e.g., `TI - Title` or
+// `ti  - Title`.
+var risTagLike = regexp.MustCompile(`^\p{Zs}*[A-Za-z][A-Za-z0-9]\p{Zs}*-`)
+
+// A `RisProblem` is one problem found by `CheckRis`. `Record` is the
+// 1-indexed number of the record containing the problem, or 0 if the
+// problem is not within a record; `LineNo` is 1-indexed, or 0 if the problem
+// concerns the whole file.
+type RisProblem struct {
+	Record int
+	LineNo int
+	Msg    string
+}
+
+func (p RisProblem) String() string {
+	var b strings.Builder
+	if p.LineNo > 0 {
+		fmt.Fprintf(&b, "line %d: ", p.LineNo)
+	}
+	if p.Record > 0 {
+		fmt.Fprintf(&b, "record %d: ", p.Record)
+	}
+	b.WriteString(p.Msg)
+	return b.String()
+}
+
+// The number of valid multibyte UTF-8 sequences in ANSI text which show
+// that the text mixes encodings. Two ANSI characters may form a valid UTF-8
+// sequence by chance, e.g., "Çœ" is the UTF-8 encoding of "ǜ", so one
+// sequence is not enough.
+const minMixedSequences = 3
+
+// `checkEncoding` reports data which is neither consistently UTF-8 nor
+// consistently single byte text. A file containing both valid multibyte
+// UTF-8 sequences and invalid bytes was probably edited with a program
+// which used a different encoding from the one the file was written in.
+func checkEncoding(data []byte, enc Encoding) []RisProblem {
+	var ps []RisProblem
+	switch enc {
+	case Utf16:
+		if len(data)%2 != 0 {
+			ps = append(ps, RisProblem{Msg: "UTF-16 data has an odd number of bytes"})
+		}
+		return ps
+	case Ansi:
+		multibyte := 0
+		for i := 0; i < len(data); {
+			r, size := utf8.DecodeRune(data[i:])
+			if r != utf8.RuneError && size > 1 {
+				multibyte++
+			}
+			i += size
+		}
+		if multibyte >= minMixedSequences {
+			bad := 0
+			for i := 0; i < len(data); {
+				r, size := utf8.DecodeRune(data[i:])
+				if r == utf8.RuneError && size == 1 {
+					bad = i
+					break
+				}
+				i += size
+			}
+			lineNo := bytes.Count(data[:bad], []byte("\n")) + 1
+			ps = append(ps, RisProblem{LineNo: lineNo,
+				Msg: "file mixes UTF-8 and ANSI encoded text"})
+		}
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		lineNo := bytes.Count(data[:i], []byte("\n")) + 1
+		ps = append(ps, RisProblem{LineNo: lineNo, Msg: "file contains a zero byte"})
+	}
+	return ps
+}
+
+// `checkLineEndings` reports decoded content which mixes CRLF and LF line
+// endings, or which contains carriage returns that do not end a line.
+func checkLineEndings(lines []string) []RisProblem {
+	var ps []RisProblem
+	firstCrlf, firstLf := 0, 0
+	for n, line := range lines {
+		lineNo := n + 1
+		last := n == len(lines)-1
+		crlf := strings.HasSuffix(line, "\r")
+		switch {
+		case last:
+			// The final line has no line ending.
+		case crlf && firstCrlf == 0:
+			firstCrlf = lineNo
+		case !crlf && firstLf == 0:
+			firstLf = lineNo
+		}
+		if strings.Contains(strings.TrimSuffix(line, "\r"), "\r") {
+			ps = append(ps, RisProblem{LineNo: lineNo, Msg: "carriage return within line"})
+		}
+	}
+	if firstCrlf > 0 && firstLf > 0 {
+		ps = append(ps, RisProblem{LineNo: max(firstCrlf, firstLf),
+			Msg: "file mixes CRLF and LF line endings"})
+	}
+	return ps
+}
+
+// `CheckRis` validates the raw content of a RIS file and returns any
+// problems found, ordered by kind and then by line.
+func CheckRis(data []byte) []RisProblem {
+	content, enc := decodeRis(data)
+	ps := checkEncoding(data, enc)
+	lines := strings.Split(content, "\n")
+	ps = append(ps, checkLineEndings(lines)...)
+
+	record, recLine := 0, 0 // current record and its first line
+	inRecord := false
+	for n, line := range lines {
+		lineNo := n + 1
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		problem := func(msg string, args ...any) {
+			r := 0
+			if inRecord {
+				r = record
+			}
+			ps = append(ps, RisProblem{Record: r, LineNo: lineNo, Msg: fmt.Sprintf(msg, args...)})
+		}
+		m := risTagLine.FindStringSubmatch(line)
+		if m == nil {
+			switch {
+			case risTagLike.MatchString(line):
+				problem("malformed tag line; expected 'XX  - value'")
+			case inRecord:
+				problem("untagged line continues the previous field")
+			default:
+				problem("text outside of a record")
+			}
+			continue
+		}
+		tag, value := m[1], strings.TrimSpace(m[2])
+		switch {
+		case tag == "TY":
+			if inRecord {
+				problem("record beginning on line %d has no ER field", recLine)
+			}
+			record++
+			recLine = lineNo
+			inRecord = true
+			if !risTypes[value] {
+				problem("unknown reference type '%s'", value)
+			}
+		case !inRecord:
+			problem("%s field outside of a record; records must begin with TY", tag)
+		case tag == "ER":
+			if value != "" {
+				problem("ER field has a value")
+			}
+			inRecord = false
+		case !risTags[tag]:
+			problem("unknown tag '%s'", tag)
+		}
+	}
+	if inRecord {
+		ps = append(ps, RisProblem{Record: record, LineNo: recLine,
+			Msg: "record is not terminated by an ER field"})
+	}
+	return ps
+}
+
+// `CheckRisFile` validates the RIS file at `fpath`.
+func CheckRisFile(fpath string) ([]RisProblem, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return CheckRis(data), nil
+}